@@ -3,12 +3,17 @@ module continue-publishing
 go 1.23.0
 
 require (
-	github.com/eclipse/paho.mqtt.golang v1.5.0
 	github.com/joho/godotenv v1.5.1
+	go-mqtt-broker v0.0.0-00010101000000-000000000000
 )
 
 require (
+	github.com/eclipse/paho.golang v0.22.0 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.5.0 // indirect
 	github.com/gorilla/websocket v1.5.3 // indirect
 	golang.org/x/net v0.27.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
 )
+
+// The shared MQTT client lives in the root module
+replace go-mqtt-broker => ../
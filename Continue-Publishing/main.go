@@ -2,14 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/joho/godotenv"
+	"go-mqtt-broker/mqttclient"
 )
 
 // Load .env file if it exists in the init function
@@ -27,96 +33,109 @@ func init() {
 	log.Println("ENV PASSWORD: ", os.Getenv("PASSWORD"))
 }
 
-// Utility function to get environment variables with a fallback default
-func getEnv(key, fallback string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
-	}
-	return fallback
-}
-
 // Configurable variables (loaded after .env is initialized)
 var (
-	mqttBroker = getEnv("MQTT_BROKER", "tcp://localhost:1883")
-	clientID   = getEnv("MQTT_CLIENT_ID", "go_mqtt_client")
-	topic      = getEnv("MQTT_TOPIC", "orodje/temp1")
+	mqttBroker = mqttclient.GetEnv("MQTT_BROKER", "tcp://localhost:1883")
+	clientID   = mqttclient.GetEnv("MQTT_CLIENT_ID", "go_mqtt_client")
+	topic      = mqttclient.GetEnv("MQTT_TOPIC", "orodje/temp1")
 	timeout    = 5 * time.Second
 )
 
-// Wait for a token to complete or a timeout
-func waitWithTimeout(token mqtt.Token, timeout time.Duration) error {
-	done := make(chan struct{})
-
-	// Wait in a separate goroutine
-	go func() {
-		token.Wait()
-		close(done)
-	}()
-
-	// Use a select statement to either wait for the token or timeout
-	select {
-	case <-done:
-		return token.Error()
-	case <-time.After(timeout):
-		return fmt.Errorf("operation timed out after %s", timeout)
+// Setup MQTT client and connect it to the broker
+func connectToMQTT(ctx context.Context, broker string, timeout time.Duration) (*mqttclient.Client, error) {
+	// Client ID, credentials, TLS, MQTT version and reconnect policy from the environment
+	envOptions, err := mqttclient.OptionsFromEnv()
+	if err != nil {
+		return nil, err
 	}
-}
-
-// Setup MQTT client and return the client object
-func connectToMQTT(broker, clientID string, timeout time.Duration, username string, password string) mqtt.Client {
-	// Generate a unique client ID using the base client ID and a timestamp
-	//uniqueClientID := fmt.Sprintf("%s-%d", clientID, time.Now().UnixNano())
-	// Define the MQTT broker options
-	opts := mqtt.NewClientOptions().AddBroker(broker)
-	opts.SetClientID(clientID)
-	opts.SetCleanSession(true)
-	opts.SetAutoReconnect(true)
-	opts.SetUsername(username)
-	opts.SetPassword(password)
-
-	// Set callback for connection lost (including duplicate client ID detection)
-	opts.OnConnectionLost = onConnectionLost
 
-	// Create an MQTT client
-	client := mqtt.NewClient(opts)
+	// The client logs lost connections, including a hint about duplicate client IDs
+	client, err := mqttclient.New(broker, append([]mqttclient.Option{
+		mqttclient.WithClientID("go_mqtt_client"),
+		mqttclient.WithCredentials("admin", "admin"),
+	}, envOptions...)...)
+	if err != nil {
+		return nil, err
+	}
 
 	// Connect to the MQTT broker with a timeout
-	token := client.Connect()
-	if err := waitWithTimeout(token, timeout); err != nil {
-		log.Fatalf("Failed to connect to MQTT broker: %v", err)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		return nil, err
 	}
 	log.Println("Connected to MQTT broker")
-	return client
+	return client, nil
 }
 
 // Publish message to the MQTT topic
-func publishMessage(client mqtt.Client, topic, message string, timeout time.Duration) {
-	token := client.Publish(topic, 0, false, message)
-	if err := waitWithTimeout(token, timeout); err != nil {
-		log.Fatalf("Failed to publish message to topic %s: %v", topic, err)
+func publishMessage(ctx context.Context, client *mqttclient.Client, topic, message string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := client.Publish(ctx, topic, 0, false, []byte(message)); err != nil {
+		return err
 	}
 	log.Printf("Published message to topic %s: %s", topic, message)
+	return nil
+}
+
+// Send a request and print the response, the responder answers on a topic of its own
+func sendRequest(ctx context.Context, client *mqttclient.Client, topic, message string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	response, err := client.Request(ctx, topic, 1, []byte(message))
+	if err != nil {
+		return err
+	}
+	log.Printf("Response on topic %s: %s", response.Topic, string(response.Payload))
+	return nil
 }
 
 func main() {
+	// With -request every line is sent as a request and the program waits for the response
+	requestMode := flag.Bool("request", false, "send each message as a request and wait for the response")
+	requestTimeout := flag.Duration("timeout", 10*time.Second, "how long to wait for a response in request mode")
+	flag.Parse()
+
 	// Load environment variables
-	mqttBroker := getEnv("MQTT_BROKER", "tcp://localhost:1883")
-	clientID := getEnv("MQTT_CLIENT_ID", "go_mqtt_client")
-	topic := getEnv("MQTT_TOPIC", "orodje/temp1")
-	username := getEnv("USERNAME", "admin")
-	password := getEnv("PASSWORD", "admin")
+	mqttBroker := mqttclient.GetEnv("MQTT_BROKER", "tcp://localhost:1883")
+	topic := mqttclient.GetEnv("MQTT_TOPIC", "orodje/temp1")
 	timeout := 5 * time.Second
 
+	// SIGINT and SIGTERM cancel ctx, which also aborts a connect or publish in progress
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	// Connect to the MQTT broker
-	client := connectToMQTT(mqttBroker, clientID, timeout, username, password)
+	client, err := connectToMQTT(ctx, mqttBroker, timeout)
+	if err != nil {
+		log.Fatalf("Failed to connect to MQTT broker: %v", err)
+	}
+	defer client.Disconnect()
 
-	// Create a reader to capture input from the user
-	reader := bufio.NewReader(os.Stdin)
+	// Read input from the user in the background, so a signal doesn't wait for the next line
+	lines := make(chan string)
+	go readLines(os.Stdin, lines)
 
 	// Loop to read input from the user and send it as a message to the topic
 	for {
-		fmt.Print("Enter message to send (or press ENTER to send a default message): ")
-		input, _ := reader.ReadString('\n') // Read user input from terminal
+		if *requestMode {
+			fmt.Print("Enter request to send (or press ENTER to send a default request): ")
+		} else {
+			fmt.Print("Enter message to send (or press ENTER to send a default message): ")
+		}
+		var input string
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				log.Println("Input closed, exiting")
+				return
+			}
+			input = line
+		case <-ctx.Done():
+			log.Println("Received signal, exiting")
+			return
+		}
 
 		// Trim the newline characters from the input
 		message := strings.TrimSpace(input)
@@ -126,18 +145,41 @@ func main() {
 			message = "Hello continuous loop"
 		}
 
+		// Send the request, a missing response doesn't end the program
+		if *requestMode {
+			err := sendRequest(ctx, client, topic, message, *requestTimeout)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Printf("No response to the request within %s", *requestTimeout)
+			} else if err != nil {
+				log.Fatalf("Failed to send request to topic %s: %v", topic, err)
+			}
+			continue
+		}
+
 		// Publish the message to the MQTT topic
-		publishMessage(client, topic, message, timeout)
+		if err := publishMessage(ctx, client, topic, message, timeout); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Fatalf("Failed to publish message to topic %s: %v", topic, err)
+		}
 	}
 }
 
-// Handle connection lost event (for duplicate client IDs)
-func onConnectionLost(client mqtt.Client, err error) {
-	log.Printf("Connection lost: %v", err)
-	if err.Error() == "Connection refused: identifier rejected" {
-		log.Println("Duplicate client ID detected.")
-	}
-	if err.Error() == "EOF" {
-		log.Println("Duplicate client ID detected.")
+// readLines sends the lines read from r to the channel and closes it at the end of the input
+func readLines(r io.Reader, lines chan<- string) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			lines <- line
+		}
+		if err != nil {
+			close(lines)
+			return
+		}
 	}
 }
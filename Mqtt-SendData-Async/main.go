@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"math/rand"
@@ -10,8 +11,8 @@ import (
 	"syscall"
 	"time"
 
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/joho/godotenv"
+	"go-mqtt-broker/mqttclient"
 )
 
 // EncoderData struct holds angle, voltage, and timestamp in nanoseconds
@@ -42,15 +43,18 @@ func generateEncoderData(startTime int64, nsPerDegree int64) string {
 }
 
 // Non-blocking function to publish data to the MQTT broker with error handling
-func publishData(client MQTT.Client, topic string, data string, retryCount int) {
+// The goroutine ends when ctx is canceled, without retrying.
+func publishData(ctx context.Context, client *mqttclient.Client, topic string, data string, retryCount int) {
 	go func() {
-		token := client.Publish(topic, 0, false, data)
-		token.Wait()
-		if token.Error() != nil {
-			log.Printf("Error publishing data: %v", token.Error())
+		err := client.Publish(ctx, topic, 0, false, []byte(data))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error publishing data: %v", err)
 			if retryCount > 0 {
 				log.Printf("Retrying... Remaining attempts: %d", retryCount)
-				publishData(client, topic, data, retryCount-1) // Retry in case of failure
+				publishData(ctx, client, topic, data, retryCount-1) // Retry in case of failure
 			}
 		} else {
 			log.Println("Data successfully published")
@@ -59,7 +63,7 @@ func publishData(client MQTT.Client, topic string, data string, retryCount int)
 }
 
 // Main loop to send data based on RPS (Revolutions Per Second)
-func startPublishing(client MQTT.Client, rps float64, topic string, dataQueue chan string, stopCh <-chan struct{}) {
+func startPublishing(ctx context.Context, client *mqttclient.Client, rps float64, topic string, dataQueue chan string) {
 	// Time per full turn (in nanoseconds)
 	nsPerFullTurn := int64((1.0 / rps) * 1e9)
 	// Time per degree in nanoseconds
@@ -67,7 +71,7 @@ func startPublishing(client MQTT.Client, rps float64, topic string, dataQueue ch
 
 	for {
 		select {
-		case <-stopCh:
+		case <-ctx.Done():
 			// Gracefully exit the loop
 			log.Println("Stopping publishing loop...")
 			return
@@ -86,22 +90,25 @@ func startPublishing(client MQTT.Client, rps float64, topic string, dataQueue ch
 				log.Println("Data queue is full, dropping data")
 			}
 
-			// Wait for the next full turn
-			time.Sleep(time.Duration(nsPerFullTurn) * time.Nanosecond)
+			// Wait for the next full turn, or stop right away on shutdown
+			select {
+			case <-time.After(time.Duration(nsPerFullTurn) * time.Nanosecond):
+			case <-ctx.Done():
+			}
 		}
 	}
 }
 
-func dataSender(client MQTT.Client, topic string, dataQueue chan string, stopCh <-chan struct{}) {
+func dataSender(ctx context.Context, client *mqttclient.Client, topic string, dataQueue chan string) {
 	for {
 		select {
-		case <-stopCh:
+		case <-ctx.Done():
 			// Gracefully exit the loop
 			log.Println("Stopping data sender...")
 			return
 		case data := <-dataQueue:
 			// Send data from the queue with retry logic
-			publishData(client, topic, data, 3)
+			publishData(ctx, client, topic, data, 3)
 		}
 	}
 }
@@ -133,24 +140,9 @@ func main() {
 		queueSize = 10
 	}
 
-	// Initialize MQTT connection options
-	opts := MQTT.NewClientOptions()
-	opts.AddBroker(mqttBroker)
-	opts.SetClientID(clientID)
-
-	// Create MQTT client
-	client := MQTT.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("Failed to connect to MQTT broker: %v", token.Error())
-	}
-	defer client.Disconnect(250)
-	log.Println("Connected to MQTT broker")
-
-	// Create a buffered channel for data queue
-	dataQueue := make(chan string, queueSize) // Buffer size from .env
-
-	// Channel to handle graceful shutdown
-	stopCh := make(chan struct{})
+	// Context canceled on shutdown, it stops the loops and aborts pending operations
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Capture interrupt signal for graceful shutdown
 	sigCh := make(chan os.Signal, 1)
@@ -159,14 +151,34 @@ func main() {
 	go func() {
 		sig := <-sigCh
 		log.Printf("Received signal: %v, shutting down...", sig)
-		close(stopCh) // Stop publishing when we receive the signal
+		cancel() // Stop publishing when we receive the signal
 	}()
 
+	// Client ID, TLS, MQTT version and reconnect policy from the environment
+	envOptions, err := mqttclient.OptionsFromEnv()
+	if err != nil {
+		log.Fatalf("Error in MQTT settings: %v", err)
+	}
+
+	// Create MQTT client and connect
+	client, err := mqttclient.New(mqttBroker, append([]mqttclient.Option{mqttclient.WithClientID(clientID)}, envOptions...)...)
+	if err != nil {
+		log.Fatalf("Error creating MQTT client: %v", err)
+	}
+	if err := client.Connect(ctx); err != nil {
+		log.Fatalf("Failed to connect to MQTT broker: %v", err)
+	}
+	defer client.Disconnect()
+	log.Println("Connected to MQTT broker")
+
+	// Create a buffered channel for data queue
+	dataQueue := make(chan string, queueSize) // Buffer size from .env
+
 	// Start goroutine to send data from the queue
-	go dataSender(client, topic, dataQueue, stopCh)
+	go dataSender(ctx, client, topic, dataQueue)
 
 	// Start publishing data
-	startPublishing(client, rps, topic, dataQueue, stopCh)
+	startPublishing(ctx, client, rps, topic, dataQueue)
 
 	log.Println("Application stopped")
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -10,7 +11,7 @@ import (
 	"syscall"
 	"time"
 
-	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"go-mqtt-broker/mqttclient"
 )
 
 // EncoderData struct holds angle, voltage, and timestamp in nanoseconds
@@ -40,17 +41,15 @@ func generateEncoderData(startTime int64, nsPerDegree int64) string {
 	return string(ysonData)
 }
 
-// Publish data to the MQTT broker with error handling
-func publishData(client MQTT.Client, topic string, data string) {
-	token := client.Publish(topic, 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		log.Printf("Error publishing data: %v", token.Error())
+// Publish data to the MQTT broker with error handling, it gives up when ctx is canceled
+func publishData(ctx context.Context, client *mqttclient.Client, topic string, data string) {
+	if err := client.Publish(ctx, topic, 0, false, []byte(data)); err != nil && ctx.Err() == nil {
+		log.Printf("Error publishing data: %v", err)
 	}
 }
 
 // Main loop to send data based on RPS (Revolutions Per Second)
-func startPublishing(client MQTT.Client, rps float64, topic string, stopCh <-chan struct{}) {
+func startPublishing(ctx context.Context, client *mqttclient.Client, rps float64, topic string) {
 	// Time per full turn (in nanoseconds)
 	nsPerFullTurn := int64((1.0 / rps) * 1e9)
 
@@ -59,7 +58,7 @@ func startPublishing(client MQTT.Client, rps float64, topic string, stopCh <-cha
 
 	for {
 		select {
-		case <-stopCh:
+		case <-ctx.Done():
 			// Gracefully exit the loop
 			log.Println("Stopping publishing loop...")
 			return
@@ -69,27 +68,54 @@ func startPublishing(client MQTT.Client, rps float64, topic string, stopCh <-cha
 
 			// Generate and send data
 			ysonData := generateEncoderData(startTime, nsPerDegree)
-			publishData(client, topic, ysonData)
+			publishData(ctx, client, topic, ysonData)
 			log.Println("Published data to MQTT broker")
 
-			// Wait for the next full turn
-			time.Sleep(time.Duration(nsPerFullTurn) * time.Nanosecond)
+			// Wait for the next full turn, or stop right away on shutdown
+			select {
+			case <-time.After(time.Duration(nsPerFullTurn) * time.Nanosecond):
+			case <-ctx.Done():
+			}
 		}
 	}
 }
 
 func main() {
-	// Initialize MQTT connection options
-	opts := MQTT.NewClientOptions()
-	opts.AddBroker("tcp://192.168.1.1:1883")
-	opts.SetClientID("encoder_simulator44")
-
-	// Create MQTT client
-	client := MQTT.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("Failed to connect to MQTT broker: %v", token.Error())
+	// The broker can be overridden with MQTT_BROKER, e.g. ssl://broker.local:8883
+	broker := "tcp://192.168.1.1:1883"
+	if value := os.Getenv("MQTT_BROKER"); value != "" {
+		broker = value
 	}
-	defer client.Disconnect(250)
+
+	// Context canceled on shutdown, it stops the loop and aborts pending operations
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Capture interrupt signal for graceful shutdown
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigCh
+		log.Printf("Received signal: %v, shutting down...", sig)
+		cancel() // Stop publishing when we receive the signal
+	}()
+
+	// Client ID, TLS, MQTT version and reconnect policy from the environment
+	envOptions, err := mqttclient.OptionsFromEnv()
+	if err != nil {
+		log.Fatalf("Error in MQTT settings: %v", err)
+	}
+
+	// Create MQTT client and connect
+	client, err := mqttclient.New(broker, append([]mqttclient.Option{mqttclient.WithClientID("encoder_simulator44")}, envOptions...)...)
+	if err != nil {
+		log.Fatalf("Error creating MQTT client: %v", err)
+	}
+	if err := client.Connect(ctx); err != nil {
+		log.Fatalf("Failed to connect to MQTT broker: %v", err)
+	}
+	defer client.Disconnect()
 	log.Println("Connected to MQTT broker")
 
 	// RPS (Revolutions Per Second) variable
@@ -106,21 +132,8 @@ func main() {
 	// MQTT topic to publish data to
 	topic := "encoder/data"
 
-	// Channel to handle graceful shutdown
-	stopCh := make(chan struct{})
-
-	// Capture interrupt signal for graceful shutdown
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		sig := <-sigCh
-		log.Printf("Received signal: %v, shutting down...", sig)
-		close(stopCh) // Stop publishing when we receive the signal
-	}()
-
 	// Start publishing data
-	startPublishing(client, rps, topic, stopCh)
+	startPublishing(ctx, client, rps, topic)
 
 	log.Println("Application stopped")
 }
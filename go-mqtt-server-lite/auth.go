@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"go-mqtt-broker/mqttclient"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CredentialsFile is the format of the file named by credentials_file in config.json
+type CredentialsFile struct {
+	Users []Credential `json:"users"`
+}
+
+// Credential is a user that can connect to the broker
+type Credential struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"` // bcrypt hash, created with the hashpw command
+	ACL          *ACL   `json:"acl,omitempty"` // Topics the user may use, all topics without it
+}
+
+// ACL lists the topic filters a user may publish and subscribe to.
+// A missing list allows all topics, an empty list allows none.
+type ACL struct {
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+}
+
+// credentialsAuth checks usernames, passwords and topics against the credentials
+// file. It implements auth.Controller of the mochi broker.
+type credentialsAuth struct {
+	users     map[string]Credential
+	dummyHash []byte // Compared for unknown users, so they take as long as wrong passwords
+}
+
+// loadCredentials reads and validates the credentials file
+func loadCredentials(filePath string) (*credentialsAuth, error) {
+	file, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var credentials CredentialsFile
+	if err := json.Unmarshal(file, &credentials); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", filePath, err)
+	}
+
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	a := &credentialsAuth{users: make(map[string]Credential), dummyHash: dummyHash}
+	for _, user := range credentials.Users {
+		if user.Username == "" {
+			return nil, fmt.Errorf("%s: user without a username", filePath)
+		}
+		if _, ok := a.users[user.Username]; ok {
+			return nil, fmt.Errorf("%s: duplicate user %s", filePath, user.Username)
+		}
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("%s: password_hash of user %s is not a bcrypt hash", filePath, user.Username)
+		}
+		if user.ACL != nil {
+			for _, filter := range append(append([]string{}, user.ACL.Publish...), user.ACL.Subscribe...) {
+				if err := mqttclient.ValidateFilter(filter); err != nil {
+					return nil, fmt.Errorf("%s: ACL of user %s: %v", filePath, user.Username, err)
+				}
+			}
+		}
+		a.users[user.Username] = user
+	}
+	return a, nil
+}
+
+// Authenticate returns true if the user exists and the password is correct
+func (a *credentialsAuth) Authenticate(user, password []byte) bool {
+	credential, ok := a.users[string(user)]
+	hash := a.dummyHash
+	if ok {
+		hash = []byte(credential.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, password); err != nil || !ok {
+		log.Printf("Authentication failed for user %q", user)
+		return false
+	}
+	return true
+}
+
+// ACL returns true if the user may publish to the topic (write) or subscribe to
+// the topic filter. A subscription is only allowed when an ACL filter covers
+// every topic it can match.
+func (a *credentialsAuth) ACL(user []byte, topic string, write bool) bool {
+	credential, ok := a.users[string(user)]
+	if !ok {
+		return false
+	}
+	if credential.ACL == nil {
+		return true
+	}
+
+	filters := credential.ACL.Subscribe
+	if write {
+		filters = credential.ACL.Publish
+	}
+	if filters == nil {
+		return true
+	}
+	for _, filter := range filters {
+		// Published messages have a topic name, subscriptions a filter that may match many topics
+		if write && mqttclient.Match(filter, topic) || !write && filterCovers(filter, topic) {
+			return true
+		}
+	}
+	if write {
+		log.Printf("User %s may not publish to %s, message dropped", user, topic)
+	} else {
+		log.Printf("User %s may not subscribe to %s", user, topic)
+	}
+	return false
+}
+
+// filterCovers reports whether every topic matched by the subscription filter
+// is also matched by the ACL filter
+func filterCovers(filter, subscription string) bool {
+	// Wildcards don't match topics starting with $, like $SYS
+	if strings.HasPrefix(subscription, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	subscriptionLevels := strings.Split(subscription, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(subscriptionLevels) {
+			return false
+		}
+		switch {
+		case subscriptionLevels[i] == "#":
+			return false // The subscription matches more levels than the filter allows
+		case level == "+":
+		case level != subscriptionLevels[i]:
+			return false // Also when the subscription has a + where the filter has a name
+		}
+	}
+	return len(filterLevels) == len(subscriptionLevels)
+}
+
+// hashPassword reads a password from stdin and prints its bcrypt hash
+func hashPassword() {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		log.Fatal("No password given")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalf("Error hashing password: %v", err)
+	}
+	fmt.Println(string(hash))
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestACL(t *testing.T) {
+	a := &credentialsAuth{users: map[string]Credential{
+		"plc1": {Username: "plc1", ACL: &ACL{
+			Publish:   []string{"plc/plc1/#"},
+			Subscribe: []string{"commands/plc1/#", "plc/+/status"},
+		}},
+	}}
+	tests := []struct {
+		topic string
+		write bool
+		want  bool
+	}{
+		{"plc/plc1/temp", true, true},
+		{"plc/plc1", true, true},
+		{"plc/plc2/temp", true, false},
+		{"$SYS/broker/uptime", true, false},
+		{"commands/plc1/#", false, true},
+		{"plc/plc2/status", false, true},
+		{"plc/+/status", false, true},
+		{"plc/#", false, false},
+		{"plc/+/+", false, false},
+	}
+	for _, test := range tests {
+		if got := a.ACL([]byte("plc1"), test.topic, test.write); got != test.want {
+			t.Errorf("ACL(%s, write %v) = %v, want %v", test.topic, test.write, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/prometheus/client_golang/prometheus"
+	"go-mqtt-broker/mqttclient"
+)
+
+const (
+	defaultBridgeClientID   = "go-mqtt-server-lite-bridge"
+	defaultBridgeBufferPath = "bridge.db"
+	defaultBridgeBufferSize = 100000
+
+	bridgeQueueSize      = 1000             // Messages waiting to be written to the buffer
+	bridgeBatchSize      = 100              // Messages published before waiting for the acknowledgements
+	bridgePublishTimeout = 10 * time.Second // Time to wait for the upstream broker to acknowledge a batch
+	bridgeRetryInterval  = time.Second      // Pause after a failed publish or while the uplink is down
+	bridgeReconnectDelay = 5 * time.Second  // First delay between connection attempts
+	bridgeReconnectMax   = time.Minute      // Longest delay between connection attempts
+)
+
+// Messages the bridge dropped, because the queue or the buffer was full
+var bridgeDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "mqtt_broker_bridge_dropped_total",
+	Help: "Outgoing bridge messages dropped because the queue or the buffer was full.",
+})
+
+// Bridge directions
+const (
+	directionIn   = "in"   // Upstream to local
+	directionOut  = "out"  // Local to upstream
+	directionBoth = "both" // Both ways
+)
+
+// BridgeConfig connects the broker to an upstream broker and forwards topics between them
+type BridgeConfig struct {
+	URL             string                  `json:"url"` // tcp://, ssl:// or ws:// URL of the upstream broker
+	ClientID        string                  `json:"client_id,omitempty"`
+	Username        string                  `json:"username,omitempty"`
+	Password        string                  `json:"password,omitempty"`
+	TLS             *mqttclient.TLSSettings `json:"tls,omitempty"`
+	ProtocolVersion int                     `json:"protocol_version,omitempty"` // 4 for MQTT 3.1.1, the default, or 5
+	Topics          []BridgeTopic           `json:"topics"`
+	BufferPath      string                  `json:"buffer_path,omitempty"` // Store-and-forward file for outgoing messages
+	BufferSize      int                     `json:"buffer_size,omitempty"` // Maximum buffered messages, the oldest are dropped
+}
+
+// BridgeTopic selects topics to forward. Like a mosquitto bridge, the local topic
+// is local_prefix + pattern and the remote topic is remote_prefix + pattern.
+type BridgeTopic struct {
+	Pattern      string `json:"pattern"`   // Topic filter, + and # wildcards are supported
+	Direction    string `json:"direction"` // in, out or both
+	QoS          byte   `json:"qos"`
+	LocalPrefix  string `json:"local_prefix,omitempty"`
+	RemotePrefix string `json:"remote_prefix,omitempty"`
+}
+
+// validateBridgeConfig checks the bridge settings and fills in the defaults
+func validateBridgeConfig(config *BridgeConfig) error {
+	if config.URL == "" {
+		return fmt.Errorf("bridge needs a url")
+	}
+	if config.ClientID == "" {
+		config.ClientID = defaultBridgeClientID
+	}
+	if config.BufferPath == "" {
+		config.BufferPath = defaultBridgeBufferPath
+	}
+	if config.BufferSize == 0 {
+		config.BufferSize = defaultBridgeBufferSize
+	}
+	if config.BufferSize < 0 {
+		return fmt.Errorf("bridge buffer_size can't be negative")
+	}
+	switch config.ProtocolVersion {
+	case 0:
+		config.ProtocolVersion = 4
+	case 4, 5:
+	default:
+		return fmt.Errorf("bridge protocol_version must be 4 (MQTT 3.1.1) or 5")
+	}
+	if len(config.Topics) == 0 {
+		return fmt.Errorf("bridge needs at least one topic")
+	}
+	for _, t := range config.Topics {
+		if err := mqttclient.ValidateFilter(t.Pattern); err != nil {
+			return fmt.Errorf("bridge topic: %v", err)
+		}
+		// The pattern is also the filter of the local topics, the local broker has no shared subscriptions
+		if group, _ := mqttclient.SplitShared(t.Pattern); group != "" {
+			return fmt.Errorf("bridge topic %s: shared subscriptions are not supported", t.Pattern)
+		}
+		switch t.Direction {
+		case directionIn, directionOut, directionBoth:
+		default:
+			return fmt.Errorf("bridge topic %s: direction must be in, out or both", t.Pattern)
+		}
+		if t.QoS > 2 {
+			return fmt.Errorf("bridge topic %s: qos must be 0, 1 or 2", t.Pattern)
+		}
+		if strings.ContainsAny(t.LocalPrefix+t.RemotePrefix, "+#") {
+			return fmt.Errorf("bridge topic %s: prefixes can't contain wildcards", t.Pattern)
+		}
+	}
+
+	// An MQTT 3.1.1 broker sends the bridge its own messages back, there is no
+	// way to tell them from other messages, so they would be forwarded in a loop.
+	// MQTT 5 subscribes with the no local option instead.
+	if config.ProtocolVersion == 5 {
+		return nil
+	}
+	for _, in := range config.Topics {
+		for _, out := range config.Topics {
+			if in.Direction == directionOut || out.Direction == directionIn {
+				continue
+			}
+			if filtersOverlap(in.RemotePrefix+in.Pattern, out.RemotePrefix+out.Pattern) {
+				return fmt.Errorf("bridge topics %s and %s forward the same remote topics both ways, this needs protocol_version 5", in.Pattern, out.Pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// filtersOverlap reports whether a topic can match both topic filters
+func filtersOverlap(a, b string) bool {
+	aLevels := strings.Split(a, "/")
+	bLevels := strings.Split(b, "/")
+	for i := 0; i < len(aLevels) && i < len(bLevels); i++ {
+		if aLevels[i] == "#" || bLevels[i] == "#" {
+			return true
+		}
+		if aLevels[i] != "+" && bLevels[i] != "+" && aLevels[i] != bLevels[i] {
+			return false
+		}
+	}
+	// "a/#" also matches "a"
+	if len(aLevels) == len(bLevels)+1 {
+		return aLevels[len(bLevels)] == "#"
+	}
+	if len(bLevels) == len(aLevels)+1 {
+		return bLevels[len(aLevels)] == "#"
+	}
+	return len(aLevels) == len(bLevels)
+}
+
+// bridge forwards messages between the local broker and the upstream broker.
+// Outgoing messages go through the store-and-forward buffer, incoming messages
+// are published to the local broker right away.
+type bridge struct {
+	config   BridgeConfig
+	srv      *server.Server
+	client   *mqttclient.Client
+	buffer   *bridgeBuffer
+	incoming chan bufferedMessage // Outgoing messages on their way to the buffer
+	wake     chan struct{}        // Signals the forwarder that there are new messages
+	ctx      context.Context      // Canceled by close, ends the goroutines and pending waits
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// startBridge opens the buffer, connects to the upstream broker and starts forwarding
+func startBridge(config BridgeConfig, srv *server.Server) (*bridge, error) {
+	buffer, err := openBridgeBuffer(config.BufferPath, config.BufferSize)
+	if err != nil {
+		return nil, fmt.Errorf("opening bridge buffer %s: %v", config.BufferPath, err)
+	}
+	b := &bridge{
+		config:   config,
+		srv:      srv,
+		buffer:   buffer,
+		incoming: make(chan bufferedMessage, bridgeQueueSize),
+		wake:     make(chan struct{}, 1),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	b.client, err = mqttclient.New(config.URL,
+		mqttclient.WithClientID(config.ClientID),
+		mqttclient.WithCredentials(config.Username, config.Password),
+		mqttclient.WithTLSSettings(config.TLS),
+		mqttclient.WithProtocolVersion(config.ProtocolVersion),
+		// Keep the upstream session, so the upstream broker queues incoming messages while the uplink is down
+		mqttclient.WithCleanSession(false),
+		mqttclient.WithConnectRetry(bridgeReconnectDelay),
+		mqttclient.WithMaxReconnectInterval(bridgeReconnectMax),
+		mqttclient.WithOnConnect(b.onConnect),
+		mqttclient.WithOnConnectionLost(func(client *mqttclient.Client, d mqttclient.Disconnect) {
+			log.Printf("Bridge connection to %s lost: %v", config.URL, d)
+		}),
+	)
+	if err != nil {
+		b.cancel()
+		buffer.close()
+		return nil, fmt.Errorf("bridge client: %v", err)
+	}
+
+	// With connect retry the client keeps trying in the background, the broker
+	// starts even when the uplink is down
+	b.client.ConnectAsync()
+
+	b.wg.Add(2)
+	go b.runBuffer()
+	go b.runForwarder()
+
+	// Forward messages published by local clients
+	srv.Events.OnMessage = b.onMessage
+
+	metrics.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mqtt_broker_bridge_connected",
+			Help: "1 when the bridge is connected to the upstream broker, 0 otherwise.",
+		}, func() float64 {
+			if b.client.IsConnected() {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mqtt_broker_bridge_buffered_messages",
+			Help: "Messages waiting to be forwarded to the upstream broker.",
+		}, func() float64 { return float64(buffer.len()) }),
+		bridgeDropped,
+	)
+
+	log.Printf("Bridge to %s started, %d messages buffered", config.URL, buffer.len())
+	return b, nil
+}
+
+// close stops forwarding, the buffered messages are sent after the next start
+func (b *bridge) close() {
+	b.cancel()
+	b.wg.Wait()
+	b.client.Disconnect()
+	if err := b.buffer.close(); err != nil {
+		log.Printf("Error closing bridge buffer: %v", err)
+	}
+}
+
+// onConnect subscribes to the incoming topics, on every (re)connect. With
+// MQTT 5 the upstream broker doesn't send back the messages the bridge forwarded.
+func (b *bridge) onConnect(client *mqttclient.Client) {
+	log.Printf("Bridge connected to %s", b.config.URL)
+	var options []mqttclient.SubscribeOption
+	if b.config.ProtocolVersion == 5 {
+		options = append(options, mqttclient.WithNoLocal())
+	}
+	for _, t := range b.config.Topics {
+		if t.Direction == directionOut {
+			continue
+		}
+		rule := t
+		filter := rule.RemotePrefix + rule.Pattern
+		ctx, cancel := context.WithTimeout(b.ctx, bridgePublishTimeout)
+		err := client.Subscribe(ctx, filter, rule.QoS, func(msg mqttclient.Message) {
+			b.onRemoteMessage(rule, msg)
+		}, options...)
+		cancel()
+		if err != nil {
+			log.Printf("Bridge failed to subscribe to %s: %v", filter, err)
+		}
+	}
+	b.signal()
+}
+
+// onMessage is the OnMessage hook of the local broker. It queues messages that
+// match an outgoing topic, without blocking the publishing client.
+func (b *bridge) onMessage(cl events.Client, pk events.Packet) (events.Packet, error) {
+	for _, t := range b.config.Topics {
+		if t.Direction == directionIn || !mqttclient.Match(t.LocalPrefix+t.Pattern, pk.TopicName) {
+			continue
+		}
+		m := bufferedMessage{
+			Topic:   t.RemotePrefix + strings.TrimPrefix(pk.TopicName, t.LocalPrefix),
+			Payload: pk.Payload,
+			QoS:     t.QoS,
+			Retain:  pk.FixedHeader.Retain,
+		}
+		select {
+		case b.incoming <- m:
+		default:
+			log.Println("Bridge queue is full, dropping message")
+			bridgeDropped.Inc()
+		}
+		break // The first matching topic wins
+	}
+	return pk, nil
+}
+
+// onRemoteMessage publishes a message from the upstream broker to the local broker.
+// Messages published this way don't pass the OnMessage hook, so they aren't sent back.
+// The local broker has no QoS for messages published by the server itself, it
+// delivers them with the QoS of each local subscription instead of the QoS the
+// message had upstream.
+func (b *bridge) onRemoteMessage(rule BridgeTopic, msg mqttclient.Message) {
+	topic := rule.LocalPrefix + strings.TrimPrefix(msg.Topic, rule.RemotePrefix)
+	if err := b.srv.Publish(topic, msg.Payload, msg.Retained); err != nil {
+		log.Printf("Bridge failed to publish %s locally: %v", topic, err)
+	}
+}
+
+// runBuffer writes queued outgoing messages to the buffer in batches
+func (b *bridge) runBuffer() {
+	defer b.wg.Done()
+	for {
+		var batch []bufferedMessage
+		select {
+		case m := <-b.incoming:
+			batch = append(batch, m)
+		case <-b.ctx.Done():
+			// Keep what was queued before the shutdown
+		}
+	drain:
+		for len(batch) < bridgeQueueSize {
+			select {
+			case m := <-b.incoming:
+				batch = append(batch, m)
+			default:
+				break drain
+			}
+		}
+
+		if len(batch) > 0 {
+			dropped, err := b.buffer.add(batch)
+			if err != nil {
+				log.Printf("Error buffering %d bridge messages: %v", len(batch), err)
+			}
+			if dropped > 0 {
+				log.Printf("Bridge buffer is full, dropped the %d oldest messages", dropped)
+				bridgeDropped.Add(float64(dropped))
+			}
+			b.signal()
+		}
+
+		select {
+		case <-b.ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// runForwarder publishes buffered messages to the upstream broker and removes
+// them once they are acknowledged
+func (b *bridge) runForwarder() {
+	defer b.wg.Done()
+	for {
+		if !b.client.IsConnected() {
+			if !b.sleep(bridgeRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		keys, messages, err := b.buffer.peek(bridgeBatchSize)
+		if err != nil {
+			log.Printf("Error reading bridge buffer: %v", err)
+			if !b.sleep(bridgeRetryInterval) {
+				return
+			}
+			continue
+		}
+		if len(keys) == 0 {
+			select {
+			case <-b.wake:
+			case <-b.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		pending := make([]*mqttclient.Pending, len(messages))
+		for i, m := range messages {
+			pending[i] = b.client.PublishAsync(m.Topic, m.QoS, m.Retain, m.Payload)
+		}
+		// Only the messages before the first failure are removed, so the failed
+		// message is sent again before the ones after it and the order is kept.
+		// Messages whose acknowledgement is still pending at close stay in the buffer.
+		var sent [][]byte
+		failed := false
+		ctx, cancel := context.WithTimeout(b.ctx, bridgePublishTimeout)
+		for i, p := range pending {
+			if err := p.Wait(ctx); err != nil {
+				failed = true
+				break
+			}
+			sent = append(sent, keys[i])
+		}
+		cancel()
+		if err := b.buffer.remove(sent); err != nil {
+			log.Printf("Error removing forwarded bridge messages: %v", err)
+		}
+		if b.ctx.Err() != nil {
+			return
+		}
+		if failed {
+			log.Printf("Bridge could not forward %d messages, retrying", len(keys)-len(sent))
+			if !b.sleep(bridgeRetryInterval) {
+				return
+			}
+		}
+	}
+}
+
+// signal wakes up the forwarder
+func (b *bridge) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sleep waits for the duration and returns false when the bridge is closed
+func (b *bridge) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-b.ctx.Done():
+		return false
+	}
+}
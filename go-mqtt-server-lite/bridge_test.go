@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestFiltersOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"site1/sensors/#", "site1/sensors/#", true},
+		{"site1/sensors/+/temp", "site1/+/line1/#", true},
+		{"site1/#", "site1", true},
+		{"site1/cmd/#", "site1/sensors/#", false},
+		{"site1/+", "site1/a/b", false},
+		{"site1/a", "site1/a/b", false},
+	}
+	for _, test := range tests {
+		if got := filtersOverlap(test.a, test.b); got != test.want {
+			t.Errorf("filtersOverlap(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+		if got := filtersOverlap(test.b, test.a); got != test.want {
+			t.Errorf("filtersOverlap(%q, %q) = %v, want %v", test.b, test.a, got, test.want)
+		}
+	}
+}
+
+func TestBridgeBothWaysNeedsMQTT5(t *testing.T) {
+	config := BridgeConfig{
+		URL:    "tcp://upstream:1883",
+		Topics: []BridgeTopic{{Pattern: "cmd/#", Direction: directionBoth, RemotePrefix: "site1/"}},
+	}
+	if err := validateBridgeConfig(&config); err == nil {
+		t.Error("direction both with MQTT 3.1.1 was accepted")
+	}
+	config.ProtocolVersion = 5
+	if err := validateBridgeConfig(&config); err != nil {
+		t.Errorf("direction both with MQTT 5: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Bucket of the store-and-forward buffer, keys are big-endian sequence numbers
+var bufferBucket = []byte("messages")
+
+// bufferedMessage is a message waiting to be forwarded to the upstream broker
+type bufferedMessage struct {
+	Topic   string `json:"topic"` // Remote topic
+	Payload []byte `json:"payload"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+// bridgeBuffer keeps outgoing bridge messages in a bbolt file, so they survive
+// an uplink outage and a restart. The oldest messages are dropped when it is full.
+type bridgeBuffer struct {
+	db    *bbolt.DB
+	size  int
+	mutex sync.Mutex // Guards count
+	count int
+}
+
+// openBridgeBuffer opens or creates the buffer file
+func openBridgeBuffer(path string, size int) (*bridgeBuffer, error) {
+	// Fail instead of waiting when another broker has the file open
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	b := &bridgeBuffer{db: db, size: size}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bufferBucket)
+		if err != nil {
+			return err
+		}
+		b.count = bucket.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// add appends the messages in one transaction and returns how many old
+// messages were dropped to stay within the size
+func (b *bridgeBuffer) add(messages []bufferedMessage) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	dropped := 0
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bufferBucket)
+		dropped = 0
+		for _, m := range messages {
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(binary.BigEndian.AppendUint64(nil, seq), value); err != nil {
+				return err
+			}
+		}
+
+		// Collect the oldest keys first, deleting at the cursor makes Next skip a key
+		var oldest [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && b.count+len(messages)-len(oldest) > b.size; k, _ = c.Next() {
+			oldest = append(oldest, k)
+		}
+		for _, k := range oldest {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		dropped = len(oldest)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	b.count += len(messages) - dropped
+	return dropped, nil
+}
+
+// peek returns up to n of the oldest messages with their keys
+func (b *bridgeBuffer) peek(n int) ([][]byte, []bufferedMessage, error) {
+	var keys [][]byte
+	var messages []bufferedMessage
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bufferBucket).Cursor()
+		for k, v := c.First(); k != nil && len(keys) < n; k, v = c.Next() {
+			var m bufferedMessage
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			keys = append(keys, append([]byte(nil), k...)) // Keys are only valid during the transaction
+			messages = append(messages, m)
+		}
+		return nil
+	})
+	return keys, messages, err
+}
+
+// remove deletes forwarded messages
+func (b *bridgeBuffer) remove(keys [][]byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	removed := 0
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bufferBucket)
+		removed = 0
+		for _, k := range keys {
+			// The message may already be dropped because the buffer was full
+			if bucket.Get(k) == nil {
+				continue
+			}
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.count -= removed
+	return nil
+}
+
+// len returns the number of buffered messages
+func (b *bridgeBuffer) len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.count
+}
+
+// close closes the buffer file
+func (b *bridgeBuffer) close() error {
+	return b.db.Close()
+}
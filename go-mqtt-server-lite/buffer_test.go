@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestBridgeBufferDropsOldest(t *testing.T) {
+	b, err := openBridgeBuffer(filepath.Join(t.TempDir(), "bridge.db"), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+
+	var messages []bufferedMessage
+	for i := 1; i <= 10; i++ {
+		messages = append(messages, bufferedMessage{Topic: "t", Payload: []byte(fmt.Sprint(i))})
+	}
+	// Overfill in two steps, so messages are dropped in a batch and across batches
+	if dropped, err := b.add(messages[:8]); err != nil || dropped != 2 {
+		t.Fatalf("first add dropped %d, %v, want 2", dropped, err)
+	}
+	if dropped, err := b.add(messages[8:]); err != nil || dropped != 2 {
+		t.Fatalf("second add dropped %d, %v, want 2", dropped, err)
+	}
+	if b.len() != 6 {
+		t.Fatalf("got %d buffered messages, want 6", b.len())
+	}
+
+	_, buffered, err := b.peek(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range buffered {
+		got = append(got, string(m.Payload))
+	}
+	if want := "[5 6 7 8 9 10]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"go-mqtt-broker/mqttclient"
+)
+
+// Config holds the broker configuration from config.json
+type Config struct {
+	Listeners       []ListenerConfig   `json:"listeners"`
+	CredentialsFile string             `json:"credentials_file,omitempty"` // Users, password hashes and ACLs, anyone can connect without it
+	Persistence     *PersistenceConfig `json:"persistence,omitempty"`      // Keeps sessions and messages across restarts, in memory only without it
+	Bridge          *BridgeConfig      `json:"bridge,omitempty"`           // Forwards topics to and from an upstream broker
+}
+
+// Persistence backends
+const persistenceBolt = "bolt" // Single bbolt database file
+
+// PersistenceConfig selects where the broker stores retained messages, sessions,
+// subscriptions and unacknowledged QoS 1/2 messages
+type PersistenceConfig struct {
+	Type string `json:"type"` // bolt
+	Path string `json:"path"` // Database file
+}
+
+// Listener types
+const (
+	listenerTCP       = "tcp"       // MQTT over TCP
+	listenerWebsocket = "websocket" // MQTT over WebSocket, for browsers
+	listenerStats     = "stats"     // HTTP endpoint with the $SYS values as JSON, basic auth with the credentials file
+	listenerMetrics   = "metrics"   // HTTP endpoint with Prometheus metrics, basic auth with the credentials file
+)
+
+// ListenerConfig is a listener of the broker, with TLS when certificates are given
+type ListenerConfig struct {
+	ID      string     `json:"id"`
+	Type    string     `json:"type,omitempty"` // tcp (default), websocket, stats or metrics
+	Address string     `json:"address"`
+	TLS     *TLSConfig `json:"tls,omitempty"`
+}
+
+// TLSConfig holds the certificates of a TLS listener
+type TLSConfig struct {
+	CertFile     string `json:"cert_file"`                // PEM server certificate, including intermediates
+	KeyFile      string `json:"key_file"`                 // PEM key of the server certificate
+	ClientCAFile string `json:"client_ca_file,omitempty"` // PEM CAs for client certificates, clients must present one when set
+}
+
+// The broker of earlier versions, used when there is no config file
+var defaultConfig = Config{
+	Listeners: []ListenerConfig{{ID: "tcp", Address: "0.0.0.0:1883"}},
+}
+
+// loadConfig reads the config file, a missing file gives the default config
+func loadConfig(filePath string) (Config, bool, error) {
+	file, err := os.ReadFile(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return defaultConfig, false, nil
+	}
+	if err != nil {
+		return Config{}, false, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(file, &config); err != nil {
+		return Config{}, false, fmt.Errorf("parsing %s: %v", filePath, err)
+	}
+	if len(config.Listeners) == 0 {
+		return Config{}, false, fmt.Errorf("%s: no listeners configured", filePath)
+	}
+	ids := make(map[string]bool)
+	for _, l := range config.Listeners {
+		if l.ID == "" || l.Address == "" {
+			return Config{}, false, fmt.Errorf("%s: every listener needs an id and an address", filePath)
+		}
+		switch l.Type {
+		case "", listenerTCP, listenerWebsocket, listenerStats, listenerMetrics:
+		default:
+			return Config{}, false, fmt.Errorf("%s: listener %s has unknown type %q", filePath, l.ID, l.Type)
+		}
+		if ids[l.ID] {
+			return Config{}, false, fmt.Errorf("%s: duplicate listener id %s", filePath, l.ID)
+		}
+		ids[l.ID] = true
+	}
+	if p := config.Persistence; p != nil {
+		if p.Type != persistenceBolt {
+			return Config{}, false, fmt.Errorf("%s: unknown persistence type %q, use bolt", filePath, p.Type)
+		}
+		if p.Path == "" {
+			return Config{}, false, fmt.Errorf("%s: persistence needs a path", filePath)
+		}
+	}
+	if config.Bridge != nil {
+		if err := validateBridgeConfig(config.Bridge); err != nil {
+			return Config{}, false, fmt.Errorf("%s: %v", filePath, err)
+		}
+	}
+	return config, true, nil
+}
+
+// listenerType returns the type of the listener, tcp when none is given
+func listenerType(l ListenerConfig) string {
+	if l.Type == "" {
+		return listenerTCP
+	}
+	return l.Type
+}
+
+// newTLSConfig loads the certificates of a TLS listener
+func newTLSConfig(settings *TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate: %v", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	// Mutual TLS, only clients with a certificate signed by these CAs can connect
+	if settings.ClientCAFile != "" {
+		if config.ClientCAs, err = mqttclient.LoadCertPool(settings.ClientCAFile); err != nil {
+			return nil, fmt.Errorf("client CA: %v", err)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
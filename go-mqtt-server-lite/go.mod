@@ -2,9 +2,31 @@ module go-mqtt-server-lite
 
 go 1.23.1
 
-require github.com/mochi-co/mqtt v1.3.2
+require (
+	github.com/mochi-co/mqtt v1.3.2
+	github.com/prometheus/client_golang v1.19.1
+	go-mqtt-broker v0.0.0-00010101000000-000000000000
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.25.0
+)
 
 require (
-	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/asdine/storm v2.1.2+incompatible // indirect
+	github.com/asdine/storm/v3 v3.2.1 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/eclipse/paho.golang v0.22.0 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.5.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
 	github.com/rs/xid v1.4.0 // indirect
+	golang.org/x/net v0.27.0 // indirect
+	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
+
+// The shared MQTT client lives in the root module
+replace go-mqtt-broker => ../
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+// httpListener serves the stats or the metrics over HTTP. It implements the
+// listener interface of mochi-co/mqtt, so it is configured like the MQTT
+// listeners, with TLS and the users of the credentials file.
+type httpListener struct {
+	id      string
+	address string
+	handler http.Handler
+	config  *listeners.Config
+	server  *http.Server
+	closed  atomic.Bool
+}
+
+// newHTTPListener creates a listener serving handler on the address
+func newHTTPListener(id, address string, handler http.Handler) *httpListener {
+	return &httpListener{id: id, address: address, handler: handler, config: &listeners.Config{Auth: new(auth.Allow)}}
+}
+
+// newStatsListener creates a listener serving the $SYS values as JSON. The values
+// are read on every request, because the broker replaces srv.System with the
+// values from the persistence store when it starts.
+func newStatsListener(id, address string, srv *server.Server) *httpListener {
+	return newHTTPListener(id, address, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, err := json.MarshalIndent(srv.System, "", "\t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(info)
+	}))
+}
+
+// SetConfig sets the TLS settings and the auth controller
+func (l *httpListener) SetConfig(config *listeners.Config) {
+	if config != nil {
+		l.config = config
+	}
+	if l.config.Auth == nil {
+		l.config.Auth = new(auth.Disallow)
+	}
+}
+
+// ID returns the id of the listener
+func (l *httpListener) ID() string {
+	return l.id
+}
+
+// Listen prepares the HTTP server
+func (l *httpListener) Listen(s *system.Info) error {
+	l.server = &http.Server{
+		Addr:              l.address,
+		Handler:           requireLogin(l.config.Auth, l.handler),
+		TLSConfig:         l.config.TLSConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return nil
+}
+
+// Serve serves requests until the listener is closed
+func (l *httpListener) Serve(establish listeners.EstablishFunc) {
+	var err error
+	if l.server.TLSConfig != nil {
+		err = l.server.ListenAndServeTLS("", "")
+	} else {
+		err = l.server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("HTTP listener %s failed: %v", l.id, err)
+	}
+}
+
+// Close stops the HTTP server
+func (l *httpListener) Close(closeClients listeners.CloseFunc) {
+	if l.closed.CompareAndSwap(false, true) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		l.server.Shutdown(ctx)
+	}
+	closeClients(l.id)
+}
+
+// requireLogin only lets users of the auth controller through, who log in with
+// HTTP basic auth. Like for the $SYS topics, users with an ACL need a $SYS/#
+// subscribe filter. Without a credentials file everyone gets through.
+func requireLogin(controller auth.Controller, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if !controller.Authenticate([]byte(user), []byte(password)) || !controller.ACL([]byte(user), "$SYS/#", false) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="MQTT broker"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback reports whether the address only accepts connections from this machine
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
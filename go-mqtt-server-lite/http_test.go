@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRequireLogin(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &credentialsAuth{dummyHash: hash, users: map[string]Credential{
+		"admin":   {Username: "admin", PasswordHash: string(hash)},
+		"monitor": {Username: "monitor", PasswordHash: string(hash), ACL: &ACL{Subscribe: []string{"$SYS/#"}}},
+		"plc1":    {Username: "plc1", PasswordHash: string(hash), ACL: &ACL{Subscribe: []string{"#"}}},
+	}}
+	handler := requireLogin(a, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		user, password string
+		want           int
+	}{
+		{"admin", "secret", http.StatusOK},
+		{"monitor", "secret", http.StatusOK},
+		{"admin", "wrong", http.StatusUnauthorized},
+		{"nobody", "secret", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+		{"plc1", "secret", http.StatusUnauthorized}, // # doesn't cover $SYS topics
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("user %q with password %q: got status %d, want %d", test.user, test.password, w.Code, test.want)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"127.0.0.1:8081", true},
+		{"localhost:8081", true},
+		{"[::1]:8081", true},
+		{"0.0.0.0:8081", false},
+		{":8081", false},
+		{"192.168.1.100:8081", false},
+	}
+	for _, test := range tests {
+		if got := isLoopback(test.address); got != test.want {
+			t.Errorf("isLoopback(%q) = %v, want %v", test.address, got, test.want)
+		}
+	}
+}
@@ -5,31 +5,106 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/mochi-co/mqtt/server"
 	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/persistence/bolt"
+	"go.etcd.io/bbolt"
 )
 
 func main() {
+	// Print the bcrypt hash of a password for the credentials file
+	if len(os.Args) > 1 && os.Args[1] == "hashpw" {
+		hashPassword()
+		return
+	}
+
+	// Load the configuration, the path can be changed with BROKER_CONFIG
+	configFile := "config.json"
+	if value := os.Getenv("BROKER_CONFIG"); value != "" {
+		configFile = value
+	}
+	config, found, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if !found {
+		log.Printf("No %s found, using a TCP listener on 0.0.0.0:1883", configFile)
+	}
+
 	// Create a new MQTT server instance
 	srv := server.New()
+	registerBrokerMetrics(srv)
 
-	// Create a TCP listener on localhost:1883 (standard MQTT port)
-	// If you want the broker to be accessible from other devices on your local network,
-	// you need to bind the listener to your local network IP address or `0.0.0.0` (all interfaces).
-	// Example:
-	// tcp := listeners.NewTCP("tcp1", "0.0.0.0:1883")
-	//
-	// Alternatively, you can bind to your specific local IP (e.g., 192.168.1.100):
-	// tcp := listeners.NewTCP("tcp1", "192.168.1.100:1883")
-	//
-	// For now, we'll use localhost to run only on the local machine.
-	tcp := listeners.NewTCP("tcp", "0.0.0.0:1883") // Change to your local network IP to allow external connections
-
-	// Add the TCP listener to the server
-	err := srv.AddListener(tcp, nil)
-	if err != nil {
-		log.Fatalf("Failed to add listener: %v", err)
+	// Restore retained messages, sessions and unacknowledged messages from disk
+	if config.Persistence != nil {
+		// Fail instead of waiting when another broker has the file open
+		store := bolt.New(config.Persistence.Path, &bbolt.Options{Timeout: time.Second})
+		if err := srv.AddStore(inflightStore{store}); err != nil {
+			log.Fatalf("Failed to open persistence store %s: %v", config.Persistence.Path, err)
+		}
+		log.Printf("Persisting sessions and messages to %s", config.Persistence.Path)
+	}
+
+	// Clients must log in with a user of the credentials file, otherwise anyone can connect
+	var authController auth.Controller = new(auth.Allow)
+	if config.CredentialsFile != "" {
+		credentials, err := loadCredentials(config.CredentialsFile)
+		if err != nil {
+			log.Fatalf("Failed to load credentials: %v", err)
+		}
+		authController = credentials
+		log.Printf("Loaded %d users from %s", len(credentials.users), config.CredentialsFile)
+	} else {
+		log.Println("WARNING: no credentials_file configured, anyone can connect, publish and subscribe")
+	}
+
+	// Create the listeners. To make the broker accessible from other devices on your
+	// local network, bind them to `0.0.0.0` (all interfaces) or your local IP address,
+	// e.g. 192.168.1.100:1883. To run only on the local machine, use localhost:1883.
+	for _, l := range config.Listeners {
+		listenerConfig := &listeners.Config{Auth: authController}
+		if l.TLS != nil {
+			if listenerConfig.TLSConfig, err = newTLSConfig(l.TLS); err != nil {
+				log.Fatalf("Failed to set up TLS for listener %s: %v", l.ID, err)
+			}
+		}
+
+		var listener listeners.Listener
+		switch l.Type {
+		case listenerWebsocket:
+			listener = listeners.NewWebsocket(l.ID, l.Address)
+		case listenerStats:
+			listener = newStatsListener(l.ID, l.Address, srv)
+		case listenerMetrics:
+			listener = newMetricsListener(l.ID, l.Address)
+		default:
+			listener = listeners.NewTCP(l.ID, l.Address)
+		}
+
+		// Add the listener to the server
+		if err := srv.AddListener(listener, listenerConfig); err != nil {
+			log.Fatalf("Failed to add listener %s: %v", l.ID, err)
+		}
+		// The HTTP endpoints only have a login with the users of the credentials file
+		if (l.Type == listenerStats || l.Type == listenerMetrics) && config.CredentialsFile == "" && !isLoopback(l.Address) {
+			log.Printf("WARNING: %s listener %s on %s has no login without credentials_file, anyone who can reach it can read it", l.Type, l.ID, l.Address)
+		}
+		if l.TLS != nil {
+			log.Printf("Listener %s (%s, TLS) on %s", l.ID, listenerType(l), l.Address)
+		} else {
+			log.Printf("Listener %s (%s) on %s", l.ID, listenerType(l), l.Address)
+		}
+	}
+
+	// Forward topics to and from the upstream broker
+	var upstream *bridge
+	if config.Bridge != nil {
+		if upstream, err = startBridge(*config.Bridge, srv); err != nil {
+			log.Fatalf("Failed to start bridge: %v", err)
+		}
 	}
 
 	// Start the broker in a goroutine
@@ -40,7 +115,7 @@ func main() {
 		}
 	}()
 
-	log.Println("MQTT broker is running on localhost:1883 or on your local IP.")
+	log.Println("MQTT broker is running.")
 
 	// Handle interrupt signal to gracefully shut down the broker
 	sig := make(chan os.Signal, 1)
@@ -49,5 +124,8 @@ func main() {
 
 	log.Println("Shutting down the broker...")
 	srv.Close()
+	if upstream != nil {
+		upstream.close()
+	}
 	log.Println("Broker stopped.")
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/system"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus metrics served by the metrics listeners
+var metrics = prometheus.NewRegistry()
+
+func init() {
+	metrics.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// newMetricsListener creates a listener serving the metrics on /metrics
+func newMetricsListener(id, address string) *httpListener {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics, promhttp.HandlerOpts{}))
+	return newHTTPListener(id, address, mux)
+}
+
+// registerBrokerMetrics exposes the state and the $SYS counters of the broker as
+// Prometheus metrics
+func registerBrokerMetrics(srv *server.Server) {
+	metrics.MustRegister(brokerCollector{srv})
+
+	// The counters are looked up on every scrape, because the broker replaces
+	// srv.System with the values from the persistence store when it starts
+	counters := []struct {
+		name, help string
+		value      func(*system.Info) *int64
+	}{
+		{"mqtt_broker_connections_total", "Client connections.", func(i *system.Info) *int64 { return &i.ConnectionsTotal }},
+		{"mqtt_broker_packets_received_total", "MQTT packets received.", func(i *system.Info) *int64 { return &i.MessagesRecv }},
+		{"mqtt_broker_packets_sent_total", "MQTT packets sent.", func(i *system.Info) *int64 { return &i.MessagesSent }},
+		{"mqtt_broker_publish_received_total", "PUBLISH packets received.", func(i *system.Info) *int64 { return &i.PublishRecv }},
+		{"mqtt_broker_publish_sent_total", "PUBLISH packets sent.", func(i *system.Info) *int64 { return &i.PublishSent }},
+		{"mqtt_broker_publish_dropped_total", "Inflight messages dropped.", func(i *system.Info) *int64 { return &i.PublishDropped }},
+		{"mqtt_broker_bytes_received_total", "Bytes received from clients.", func(i *system.Info) *int64 { return &i.BytesRecv }},
+		{"mqtt_broker_bytes_sent_total", "Bytes sent to clients.", func(i *system.Info) *int64 { return &i.BytesSent }},
+	}
+	for _, c := range counters {
+		value := c.value
+		metrics.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{Name: c.name, Help: c.help},
+			func() float64 { return float64(atomic.LoadInt64(value(srv.System))) }))
+	}
+}
+
+var (
+	clientsDesc       = prometheus.NewDesc("mqtt_broker_clients", "Clients known to the broker, by state.", []string{"state"}, nil)
+	inflightDesc      = prometheus.NewDesc("mqtt_broker_inflight_messages", "QoS 1 and 2 messages waiting for an acknowledgement, including those queued for offline clients.", nil, nil)
+	retainedDesc      = prometheus.NewDesc("mqtt_broker_retained_messages", "Retained messages, without the $SYS topics.", nil, nil)
+	subscriptionsDesc = prometheus.NewDesc("mqtt_broker_subscriptions", "Topic filter subscriptions of connected and offline clients.", nil, nil)
+)
+
+// brokerCollector counts clients, inflight and retained messages and subscriptions
+// when the metrics are scraped. The gauges of srv.System can't be used, mochi-co/mqtt
+// v1.3.2 restores them from the persistence store and then counts on top of them.
+type brokerCollector struct {
+	srv *server.Server
+}
+
+// Describe sends the descriptions of the metrics
+func (c brokerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientsDesc
+	ch <- inflightDesc
+	ch <- retainedDesc
+	ch <- subscriptionsDesc
+}
+
+// Collect sends the current values
+func (c brokerCollector) Collect(ch chan<- prometheus.Metric) {
+	connected, offline, inflight, subscriptions := 0, 0, 0, 0
+	for _, cl := range c.srv.Clients.GetAll() {
+		if atomic.LoadUint32(&cl.State.Done) == 0 {
+			connected++
+		} else {
+			offline++
+		}
+		inflight += cl.Inflight.Len()
+		cl.RLock()
+		subscriptions += len(cl.Subscriptions)
+		cl.RUnlock()
+	}
+
+	retained := 0
+	for _, pk := range c.srv.Topics.Messages("#") {
+		if !strings.HasPrefix(pk.TopicName, "$") {
+			retained++
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(clientsDesc, prometheus.GaugeValue, float64(connected), "connected")
+	ch <- prometheus.MustNewConstMetric(clientsDesc, prometheus.GaugeValue, float64(offline), "offline")
+	ch <- prometheus.MustNewConstMetric(inflightDesc, prometheus.GaugeValue, float64(inflight))
+	ch <- prometheus.MustNewConstMetric(retainedDesc, prometheus.GaugeValue, float64(retained))
+	ch <- prometheus.MustNewConstMetric(subscriptionsDesc, prometheus.GaugeValue, float64(subscriptions))
+}
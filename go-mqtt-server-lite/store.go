@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mochi-co/mqtt/server/persistence"
+	"github.com/mochi-co/mqtt/server/persistence/bolt"
+)
+
+// inflightStore fixes the inflight messages the broker writes to the bolt store.
+// mochi-co/mqtt v1.3.2 leaves out the client and packet ID, so messages queued
+// for offline clients were stored but never restored after a restart.
+type inflightStore struct {
+	*bolt.Store
+}
+
+// WriteInflight fills in the client and packet ID from the storage key, which
+// the broker builds as "if_<client ID>_<packet ID>"
+func (s inflightStore) WriteInflight(m persistence.Message) error {
+	if key, ok := strings.CutPrefix(m.ID, "if_"); ok && m.Client == "" {
+		if i := strings.LastIndex(key, "_"); i >= 0 {
+			if id, err := strconv.ParseUint(key[i+1:], 10, 16); err == nil {
+				m.Client = key[:i]
+				m.PacketID = uint16(id)
+			}
+		}
+	}
+	// Without a creation time the message would expire at the first cleanup
+	if m.Created == 0 {
+		m.Created = m.Sent
+	}
+	return s.Store.WriteInflight(m)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/persistence/bolt"
+	"go-mqtt-broker/mqttclient"
+	"go.etcd.io/bbolt"
+)
+
+// startPersistentBroker starts a broker with the bolt store at path and returns
+// its URL
+func startPersistentBroker(t *testing.T, path string) (*server.Server, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	srv := server.New()
+	if err := srv.AddStore(inflightStore{bolt.New(path, &bbolt.Options{Timeout: time.Second})}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AddListener(listeners.NewTCP("t1", address), &listeners.Config{Auth: new(auth.Allow)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	return srv, "tcp://" + address
+}
+
+func TestStoreRestoresAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.db")
+	srv, url := startPersistentBroker(t, path)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A client with a session subscribes and goes offline
+	subscriber, err := mqttclient.New(url, mqttclient.WithClientID("plc-sub"), mqttclient.WithCleanSession(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := subscriber.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := subscriber.Subscribe(ctx, "plc/#", 1, func(mqttclient.Message) {}); err != nil {
+		t.Fatal(err)
+	}
+	subscriber.Disconnect()
+
+	// The messages for it are queued as inflight, one is also retained
+	publisher, err := mqttclient.New(url, mqttclient.WithClientID("plc-pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(ctx, "plc/1", 1, true, []byte("21.5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(ctx, "plc/2", 1, false, []byte("22")); err != nil {
+		t.Fatal(err)
+	}
+	publisher.Disconnect()
+	srv.Close()
+
+	// A new broker on the same file has the session, subscription, inflight
+	// and retained messages
+	srv, _ = startPersistentBroker(t, path)
+	defer srv.Close()
+
+	client, ok := srv.Clients.Get("plc-sub")
+	if !ok {
+		t.Fatal("the session of plc-sub was not restored")
+	}
+	inflight := map[string]string{}
+	for _, m := range client.Inflight.GetAll() {
+		inflight[m.Packet.TopicName] = string(m.Packet.Payload)
+	}
+	if len(inflight) != 2 || inflight["plc/1"] != "21.5" || inflight["plc/2"] != "22" {
+		t.Errorf("got inflight messages %v, want plc/1 and plc/2", inflight)
+	}
+	if subscribers := srv.Topics.Subscribers("plc/1"); subscribers["plc-sub"] != 1 {
+		t.Errorf("got subscribers %v for plc/1, want plc-sub with QoS 1", subscribers)
+	}
+	if retained := srv.Topics.Messages("plc/#"); len(retained) != 1 || string(retained[0].Payload) != "21.5" {
+		t.Errorf("got %d retained messages, want the one of plc/1", len(retained))
+	}
+}
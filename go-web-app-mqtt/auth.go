@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles of users and API tokens, each role includes the permissions of the ones before it
+const (
+	roleViewer    = "viewer"    // Read messages, history, charts and stats
+	rolePublisher = "publisher" // Also publish messages
+	roleAdmin     = "admin"     // Also read the config and manage subscriptions
+)
+
+var roleRanks = map[string]int{roleViewer: 1, rolePublisher: 2, roleAdmin: 3}
+
+const (
+	sessionCookieName = "mqtt_session"
+	sessionLifetime   = 12 * time.Hour
+	loginFailureDelay = time.Second // Slows down password guessing
+	principalKey      = "principal" // Key of the authenticated principal in the gin context
+)
+
+// UsersFile is the format of the file named by users_file in config.json
+type UsersFile struct {
+	Users  []User     `json:"users"`
+	Tokens []APIToken `json:"tokens"`
+}
+
+// User can log in to the dashboard with a password
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"` // bcrypt hash, created with the hashpw command
+	Role         string `json:"role"`
+}
+
+// APIToken authenticates scripts with an "Authorization: Bearer <token>" header
+type APIToken struct {
+	Name      string `json:"name"`
+	TokenHash string `json:"token_hash"` // Hex SHA-256 of the token, created with the newtoken command
+	Role      string `json:"role"`
+}
+
+// principal is the authenticated user or token of a request
+type principal struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// session is a logged in browser, identified by the random ID in its cookie
+type session struct {
+	username string
+	expires  time.Time
+}
+
+// userStore holds the users and tokens of the users file and the login sessions
+type userStore struct {
+	path      string
+	mutex     sync.RWMutex
+	users     map[string]User
+	tokens    map[string]APIToken // By token hash
+	modTime   time.Time
+	dummyHash []byte // Compared for unknown users, so they take as long as wrong passwords
+
+	sessionsMutex sync.Mutex
+	sessions      map[string]session
+}
+
+// Users of the dashboard, nil when no users_file is configured and authentication is disabled
+var users *userStore
+
+// loadUserStore reads the users file
+func loadUserStore(path string) (*userStore, error) {
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	s := &userStore{path: path, dummyHash: dummyHash, sessions: make(map[string]session)}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads and validates the users file, on error the previous users stay in effect
+func (s *userStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var file UsersFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parsing users file: %v", err)
+	}
+
+	users := make(map[string]User)
+	for _, user := range file.Users {
+		if user.Username == "" {
+			return fmt.Errorf("user without a username")
+		}
+		if _, ok := users[user.Username]; ok {
+			return fmt.Errorf("duplicate user %s", user.Username)
+		}
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return fmt.Errorf("user %s: password_hash is not a bcrypt hash", user.Username)
+		}
+		if roleRanks[user.Role] == 0 {
+			return fmt.Errorf("user %s: unknown role %q", user.Username, user.Role)
+		}
+		users[user.Username] = user
+	}
+	tokens := make(map[string]APIToken)
+	for _, token := range file.Tokens {
+		hash := strings.ToLower(token.TokenHash)
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("token %s: token_hash is not a hex SHA-256 hash", token.Name)
+		}
+		if roleRanks[token.Role] == 0 {
+			return fmt.Errorf("token %s: unknown role %q", token.Name, token.Role)
+		}
+		tokens[hash] = token
+	}
+
+	s.mutex.Lock()
+	s.users = users
+	s.tokens = tokens
+	s.modTime = info.ModTime()
+	s.mutex.Unlock()
+	return nil
+}
+
+// watch reloads the users file when it changes and removes expired sessions. It never returns.
+func (s *userStore) watch() {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.mutex.RLock()
+		modTime := s.modTime
+		s.mutex.RUnlock()
+		if info, err := os.Stat(s.path); err == nil && !info.ModTime().Equal(modTime) {
+			if err := s.reload(); err != nil {
+				log.Printf("Error reloading users file, keeping the last good users: %v", err)
+			} else {
+				fmt.Println("Users reloaded from", s.path)
+			}
+		}
+
+		s.sessionsMutex.Lock()
+		for id, sess := range s.sessions {
+			if now.After(sess.expires) {
+				delete(s.sessions, id)
+			}
+		}
+		s.sessionsMutex.Unlock()
+	}
+}
+
+// checkPassword returns the user if the password is correct
+func (s *userStore) checkPassword(username, password string) (User, bool) {
+	s.mutex.RLock()
+	user, ok := s.users[username]
+	s.mutex.RUnlock()
+
+	hash := s.dummyHash
+	if ok {
+		hash = []byte(user.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return User{}, false
+	}
+	return user, true
+}
+
+// authenticateRequest checks the bearer token or the session cookie of the request
+func (s *userStore) authenticateRequest(c *gin.Context) (principal, bool) {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+		s.mutex.RLock()
+		apiToken, ok := s.tokens[hex.EncodeToString(sum[:])]
+		s.mutex.RUnlock()
+		return principal{Name: apiToken.Name, Role: apiToken.Role}, ok
+	}
+
+	id, err := c.Cookie(sessionCookieName)
+	if err != nil {
+		return principal{}, false
+	}
+	s.sessionsMutex.Lock()
+	sess, ok := s.sessions[id]
+	s.sessionsMutex.Unlock()
+	if !ok || time.Now().After(sess.expires) {
+		return principal{}, false
+	}
+
+	// The role is looked up on every request, so changes to the users file apply to open sessions
+	s.mutex.RLock()
+	user, ok := s.users[sess.username]
+	s.mutex.RUnlock()
+	return principal{Name: user.Username, Role: user.Role}, ok
+}
+
+// newSession starts a session for the user and returns its ID
+func (s *userStore) newSession(username string) (string, error) {
+	id, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	s.sessionsMutex.Lock()
+	s.sessions[id] = session{username: username, expires: time.Now().Add(sessionLifetime)}
+	s.sessionsMutex.Unlock()
+	return id, nil
+}
+
+// endSession removes the session
+func (s *userStore) endSession(id string) {
+	s.sessionsMutex.Lock()
+	delete(s.sessions, id)
+	s.sessionsMutex.Unlock()
+}
+
+// randomToken returns 32 random bytes as hex
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authenticate rejects requests without a valid token or session. Browsers asking
+// for the dashboard are sent to the login page, other requests get a 401.
+func authenticate(c *gin.Context) {
+	if users == nil {
+		c.Set(principalKey, principal{Name: "anonymous", Role: roleAdmin})
+		return
+	}
+	p, ok := users.authenticateRequest(c)
+	if !ok {
+		if c.Request.Method == http.MethodGet && c.Request.URL.Path == "/" {
+			c.Redirect(http.StatusFound, "/login")
+			c.Abort()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	c.Set(principalKey, p)
+}
+
+// requireRole rejects requests of principals without at least the given role
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := c.MustGet(principalKey).(principal)
+		if roleRanks[p.Role] < roleRanks[role] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Requires the %s role", role)})
+		}
+	}
+}
+
+// serveLogin shows the login form
+func serveLogin(c *gin.Context) {
+	if users == nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	c.HTML(http.StatusOK, "login.html", gin.H{})
+}
+
+// login checks the username and password of the login form and starts a session
+func login(c *gin.Context) {
+	if users == nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	username := c.PostForm("username")
+	user, ok := users.checkPassword(username, c.PostForm("password"))
+	if !ok {
+		log.Printf("Failed login for user %q from %s", username, c.ClientIP())
+		time.Sleep(loginFailureDelay)
+		c.HTML(http.StatusUnauthorized, "login.html", gin.H{"Error": "Invalid username or password", "Username": username})
+		return
+	}
+
+	id, err := users.newSession(user.Username)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"Error": "Could not log in, try again"})
+		return
+	}
+	// SameSite=Strict keeps other sites from sending requests with the session
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(sessionCookieName, id, int(sessionLifetime/time.Second), "/", "", c.Request.TLS != nil, true)
+	log.Printf("User %s logged in from %s", user.Username, c.ClientIP())
+	c.Redirect(http.StatusFound, "/")
+}
+
+// logout ends the session of the browser
+func logout(c *gin.Context) {
+	if id, err := c.Cookie(sessionCookieName); err == nil && users != nil {
+		users.endSession(id)
+	}
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(sessionCookieName, "", -1, "/", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, "/login")
+}
+
+// serveMe returns the name and role of the authenticated principal
+func serveMe(c *gin.Context) {
+	p := c.MustGet(principalKey).(principal)
+	c.JSON(http.StatusOK, gin.H{"name": p.Name, "role": p.Role, "auth_enabled": users != nil})
+}
+
+// runUserCommand runs the helper commands for the users file:
+//
+//	hashpw    reads a password from stdin and prints its bcrypt hash
+//	newtoken  prints a new API token and the hash to put in the users file
+func runUserCommand(args []string) {
+	switch args[0] {
+	case "hashpw":
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			log.Fatal("No password given")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalf("Error hashing password: %v", err)
+		}
+		fmt.Println(string(hash))
+	case "newtoken":
+		token, err := randomToken()
+		if err != nil {
+			log.Fatalf("Error creating token: %v", err)
+		}
+		sum := sha256.Sum256([]byte(token))
+		fmt.Println("token:     ", token)
+		fmt.Println("token_hash:", hex.EncodeToString(sum[:]))
+	default:
+		log.Fatalf("Unknown command %q, use hashpw or newtoken", args[0])
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-mqtt-broker/mqttclient"
+)
+
+const (
+	defaultSeriesWindow = time.Hour // Time range when no from parameter is given
+	targetSeriesPoints  = 300       // Points per series when no bucket size is given
+	maxSeriesPoints     = 5000      // Upper bound for the number of buckets per series
+)
+
+// Series is the bucketed numeric data of one topic and field
+type Series struct {
+	Topic  string        `json:"topic"`
+	Field  string        `json:"field,omitempty"`
+	Unit   string        `json:"unit,omitempty"`
+	Points []SeriesPoint `json:"points"`
+}
+
+// SeriesPoint holds the aggregated values of one time bucket
+type SeriesPoint struct {
+	Time  time.Time `json:"t"` // Start of the bucket
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Count int64     `json:"count"`
+}
+
+// seriesResponse is the JSON response of /api/series
+type seriesResponse struct {
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	BucketSeconds int64     `json:"bucket_seconds"`
+	Series        []Series  `json:"series"`
+}
+
+// parseNumber is registered as the SQL function mqtt_number. It returns the
+// numeric value of a payload, or NULL when the payload is not a number.
+func parseNumber(value any) any {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil
+		}
+		return f
+	}
+	return nil
+}
+
+// serveSeries returns numeric data aggregated into time buckets, one series per topic.
+// Without a field the numeric payloads are used, including the buckets kept by the
+// retention rules; with a field the values decoded by the payload schema are used.
+//
+// Query parameters:
+//
+//	topic   MQTT topic filter (required, + and # wildcards are supported)
+//	field   decoded field name
+//	from    RFC 3339 time or date, inclusive, one hour ago by default
+//	to      RFC 3339 time or date, exclusive, now by default
+//	bucket  bucket size as Go duration, e.g. 1m, chosen from the time range by default
+func serveSeries(c *gin.Context) {
+	filter := c.Query("topic")
+	if err := mqttclient.ValidateFilter(filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	field := c.Query("field")
+
+	to := time.Now().UTC()
+	if value := c.Query("to"); value != "" {
+		t, err := parseTimeParam(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid to parameter: %v", err)})
+			return
+		}
+		to = t.UTC()
+	}
+	from := to.Add(-defaultSeriesWindow)
+	if value := c.Query("from"); value != "" {
+		t, err := parseTimeParam(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid from parameter: %v", err)})
+			return
+		}
+		from = t.UTC()
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	bucket := max(to.Sub(from)/targetSeriesPoints, time.Second).Round(time.Second)
+	if value := c.Query("bucket"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Second {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bucket must be a duration of at least 1s"})
+			return
+		}
+		bucket = d.Round(time.Second)
+	}
+	if to.Sub(from)/bucket > maxSeriesPoints {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("too many buckets, use a bucket of at least %s", (to.Sub(from) / maxSeriesPoints).Round(time.Second))})
+		return
+	}
+
+	series, err := querySeries(filter, field, from, to, int64(bucket/time.Second))
+	if err != nil {
+		log.Printf("Error querying series: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not query series"})
+		return
+	}
+
+	c.JSON(http.StatusOK, seriesResponse{
+		From:          from,
+		To:            to,
+		BucketSeconds: int64(bucket / time.Second),
+		Series:        series,
+	})
+}
+
+// querySeries aggregates the data of the topics matching the filter into buckets
+func querySeries(filter, field string, from, to time.Time, bucketSeconds int64) ([]Series, error) {
+	fromText := from.Format(dbTimeLayout)
+	toText := to.Format(dbTimeLayout)
+
+	// Both sources return topic, bucket, min, max, sum, count and unit
+	var query string
+	var args []any
+	if field == "" {
+		query = `
+		SELECT topic, bucket, MIN(min_value), MAX(max_value), SUM(value_sum), SUM(value_count), '' FROM (
+			SELECT topic,
+				CAST(strftime('%s', received_at) AS INTEGER) / ? * ? AS bucket,
+				MIN(mqtt_number(message)) AS min_value,
+				MAX(mqtt_number(message)) AS max_value,
+				SUM(mqtt_number(message)) AS value_sum,
+				COUNT(mqtt_number(message)) AS value_count
+			FROM mqtt_data_received
+			WHERE received_at >= ? AND received_at < ? AND mqtt_match(?, topic)
+			GROUP BY topic, bucket
+			UNION ALL
+			SELECT topic,
+				CAST(strftime('%s', bucket_start) AS INTEGER) / ? * ? AS bucket,
+				MIN(min_value), MAX(max_value), SUM(value_sum), SUM(value_count)
+			FROM mqtt_data_downsampled
+			WHERE field = '' AND bucket_start >= ? AND bucket_start < ? AND mqtt_match(?, topic)
+			GROUP BY topic, bucket
+		)
+		WHERE value_count > 0
+		GROUP BY topic, bucket
+		ORDER BY topic, bucket;
+		`
+		args = []any{bucketSeconds, bucketSeconds, fromText, toText, filter,
+			bucketSeconds, bucketSeconds, fromText, toText, filter}
+	} else {
+		query = `
+		SELECT topic, bucket, MIN(min_value), MAX(max_value), SUM(value_sum), SUM(value_count), MAX(unit) FROM (
+			SELECT topic,
+				CAST(strftime('%s', received_at) AS INTEGER) / ? * ? AS bucket,
+				MIN(value_num) AS min_value,
+				MAX(value_num) AS max_value,
+				SUM(value_num) AS value_sum,
+				COUNT(value_num) AS value_count,
+				MAX(COALESCE(unit, '')) AS unit
+			FROM mqtt_data_values
+			WHERE field = ? AND received_at >= ? AND received_at < ? AND mqtt_match(?, topic)
+				AND value_type IN ('float', 'int')
+			GROUP BY topic, bucket
+			UNION ALL
+			SELECT topic,
+				CAST(strftime('%s', bucket_start) AS INTEGER) / ? * ? AS bucket,
+				MIN(min_value), MAX(max_value), SUM(value_sum), SUM(value_count), MAX(COALESCE(unit, ''))
+			FROM mqtt_data_downsampled
+			WHERE field = ? AND bucket_start >= ? AND bucket_start < ? AND mqtt_match(?, topic)
+			GROUP BY topic, bucket
+		)
+		WHERE value_count > 0
+		GROUP BY topic, bucket
+		ORDER BY topic, bucket;
+		`
+		args = []any{bucketSeconds, bucketSeconds, field, fromText, toText, filter,
+			bucketSeconds, bucketSeconds, field, fromText, toText, filter}
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	series := []Series{}
+	for rows.Next() {
+		var (
+			topic, unit   string
+			bucket, count int64
+			p             SeriesPoint
+			sum           float64
+		)
+		if err := rows.Scan(&topic, &bucket, &p.Min, &p.Max, &sum, &count, &unit); err != nil {
+			return nil, err
+		}
+		p.Time = time.Unix(bucket, 0).UTC()
+		p.Count = count
+		p.Avg = sum / float64(count)
+
+		if len(series) == 0 || series[len(series)-1].Topic != topic {
+			series = append(series, Series{Topic: topic, Field: field, Unit: unit})
+		}
+		series[len(series)-1].Points = append(series[len(series)-1].Points, p)
+	}
+	return series, rows.Err()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-mqtt-broker/mqttclient"
+)
+
+// How often config.json is checked for changes
+const configPollInterval = 2 * time.Second
+
+// Load and validate the configuration from config.json
+func loadConfig(filePath string) (Config, error) {
+	var config Config
+	file, err := os.ReadFile(filePath)
+	if err != nil {
+		return config, fmt.Errorf("reading config file: %v", err)
+	}
+	if err := json.Unmarshal(file, &config); err != nil {
+		return config, fmt.Errorf("parsing config file: %v", err)
+	}
+	if err := validateConfig(config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// validateConfig checks the settings that can't be checked while parsing
+func validateConfig(config Config) error {
+	if config.WebAppPort <= 0 || config.WebAppPort > 65535 {
+		return fmt.Errorf("web_app_port must be between 1 and 65535")
+	}
+	if config.MQTTBrokerURL == "" {
+		return fmt.Errorf("mqtt_broker_url is required")
+	}
+	topics := make(map[string]bool)
+	for _, sub := range config.MQTTTopics {
+		if err := validateSubscription(sub); err != nil {
+			return fmt.Errorf("mqtt_topics: %v", err)
+		}
+		if topics[sub.Topic] {
+			return fmt.Errorf("mqtt_topics: duplicate topic filter %s", sub.Topic)
+		}
+		topics[sub.Topic] = true
+	}
+	if _, err := mqttclient.NewTLSConfig(config.MQTTTLS); err != nil {
+		return fmt.Errorf("mqtt_tls: %v", err)
+	}
+	switch config.MQTTProtocolVersion {
+	case 0, 4, 5:
+	default:
+		return fmt.Errorf("mqtt_protocol_version must be 4 (MQTT 3.1.1) or 5")
+	}
+	if config.DBQueueSize < 0 || config.DBBatchSize < 0 || config.DBFlushIntervalMS < 0 {
+		return fmt.Errorf("db_queue_size, db_batch_size and db_flush_interval_ms can't be negative")
+	}
+	if config.MessageBufferSize < 0 {
+		return fmt.Errorf("message_buffer_size can't be negative")
+	}
+	if err := validatePipelineConfig(config.Pipeline); err != nil {
+		return fmt.Errorf("pipeline: %v", err)
+	}
+	if _, _, _, err := parseRetentionConfig(config.Retention); err != nil {
+		return fmt.Errorf("retention: %v", err)
+	}
+	if err := validatePayloadSchemas(config.PayloadSchemas); err != nil {
+		return fmt.Errorf("payload_schemas: %v", err)
+	}
+	return nil
+}
+
+// Save the current configuration to the config file. The file is replaced
+// atomically, so a crash while saving can't leave a truncated config behind.
+func saveConfig(filePath string) error {
+	configMutex.RLock()
+	data, err := json.MarshalIndent(currentConfig, "", "    ")
+	configMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmpFile := filePath + ".tmp"
+	if err := os.WriteFile(tmpFile, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filePath)
+}
+
+// currentMQTTClient returns the MQTT client, which is replaced when the broker settings change
+func currentMQTTClient() *mqttclient.Client {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return mqttClient
+}
+
+// watchConfig polls the config file and applies changes. It never returns.
+// Polling instead of file system events also catches editors that save by
+// replacing the file.
+func watchConfig(filePath string) {
+	var lastModTime time.Time
+	var lastSize int64
+	if info, err := os.Stat(filePath); err == nil {
+		lastModTime, lastSize = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			continue // The file may be replaced right now, try again on the next tick
+		}
+		if info.ModTime().Equal(lastModTime) && info.Size() == lastSize {
+			continue
+		}
+		lastModTime, lastSize = info.ModTime(), info.Size()
+		reloadConfig(filePath)
+	}
+}
+
+// reloadConfig loads the config file and applies it. An invalid file is
+// logged and the last good configuration stays in effect.
+func reloadConfig(filePath string) {
+	config, err := loadConfig(filePath)
+	if err != nil {
+		log.Printf("Error reloading config, keeping the last good config: %v", err)
+		return
+	}
+
+	// Changes to the subscriptions are serialized with the subscriptions API
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+
+	configMutex.RLock()
+	oldConfig := currentConfig
+	configMutex.RUnlock()
+	if reflect.DeepEqual(config, oldConfig) {
+		return // Saved by the subscriptions API, or touched without changes
+	}
+
+	if err := applyConfig(oldConfig, config); err != nil {
+		log.Printf("Error applying config, keeping the last good config: %v", err)
+		return
+	}
+	fmt.Println("Config reloaded from", filePath)
+}
+
+// applyConfig switches from the old to the new configuration. Broker, client ID, protocol,
+// TLS, topic and payload schema changes take effect right away, the other settings are
+// only read at startup.
+func applyConfig(oldConfig, config Config) error {
+	if config.MQTTBrokerURL != oldConfig.MQTTBrokerURL || config.MQTTClientID != oldConfig.MQTTClientID ||
+		!reflect.DeepEqual(config.MQTTTLS, oldConfig.MQTTTLS) || config.MQTTProtocolVersion != oldConfig.MQTTProtocolVersion {
+		if err := reconnectMQTT(oldConfig, config); err != nil {
+			return err
+		}
+	} else {
+		configMutex.Lock()
+		currentConfig = config
+		configMutex.Unlock()
+		updateSubscriptions(currentMQTTClient(), oldConfig.MQTTTopics, config.MQTTTopics)
+	}
+
+	if config.WebAppPort != oldConfig.WebAppPort {
+		log.Println("web_app_port changed, restart the app to apply it")
+	}
+	if config.DBQueueSize != oldConfig.DBQueueSize || config.DBBatchSize != oldConfig.DBBatchSize || config.DBFlushIntervalMS != oldConfig.DBFlushIntervalMS {
+		log.Println("Database writer settings changed, restart the app to apply them")
+	}
+	if config.MessageBufferSize != oldConfig.MessageBufferSize {
+		log.Println("message_buffer_size changed, restart the app to apply it")
+	}
+	if !reflect.DeepEqual(config.Pipeline, oldConfig.Pipeline) {
+		log.Println("Pipeline settings changed, restart the app to apply them")
+	}
+	if config.UsersFile != oldConfig.UsersFile {
+		log.Println("users_file changed, restart the app to apply it")
+	}
+	if !reflect.DeepEqual(config.Retention, oldConfig.Retention) {
+		log.Println("Retention settings changed, restart the app to apply them")
+	}
+	return nil
+}
+
+// reconnectMQTT replaces the MQTT client with one for the new broker settings.
+// The old client disconnects first, so a new connection with the same client ID
+// isn't taken over by the old one. When the new broker can't be reached, the old
+// client connects again.
+func reconnectMQTT(oldConfig, config Config) error {
+	oldClient := currentMQTTClient()
+	oldClient.Disconnect()
+
+	// The new client subscribes to the topics of the config in effect when it connects
+	configMutex.Lock()
+	currentConfig = config
+	configMutex.Unlock()
+
+	client, err := connectToMQTTBroker(config)
+	if err != nil {
+		configMutex.Lock()
+		currentConfig = oldConfig
+		configMutex.Unlock()
+		if err := oldClient.Connect(context.Background()); err != nil {
+			log.Printf("Error reconnecting to MQTT broker %s: %v", oldConfig.MQTTBrokerURL, err)
+		}
+		return fmt.Errorf("connecting to MQTT broker %s: %v", config.MQTTBrokerURL, err)
+	}
+
+	configMutex.Lock()
+	mqttClient = client
+	configMutex.Unlock()
+	return nil
+}
+
+// updateSubscriptions applies the changes between the old and the new
+// subscriptions. Failures are logged, the remaining changes are still applied.
+func updateSubscriptions(client *mqttclient.Client, oldSubscriptions, subscriptions []Subscription) {
+	unsubscribe, subscribe := subscriptionChanges(oldSubscriptions, subscriptions)
+	for _, topic := range unsubscribe {
+		if err := unsubscribeFromTopic(context.Background(), client, topic); err != nil {
+			log.Printf("Error unsubscribing from topic %s: %v", topic, err)
+		}
+	}
+	for _, sub := range subscribe {
+		if err := subscribeToTopic(context.Background(), client, sub); err != nil {
+			log.Printf("Error subscribing to topic %s: %v", sub.Topic, err)
+		}
+	}
+}
+
+// subscriptionChanges returns the removed topic filters, and the new subscriptions
+// and those whose QoS changed. A QoS change needs no unsubscribe, subscribing
+// again replaces the subscription.
+func subscriptionChanges(oldSubscriptions, subscriptions []Subscription) (unsubscribe []string, subscribe []Subscription) {
+	for _, old := range oldSubscriptions {
+		if !slices.ContainsFunc(subscriptions, func(s Subscription) bool { return s.Topic == old.Topic }) {
+			unsubscribe = append(unsubscribe, old.Topic)
+		}
+	}
+	for _, sub := range subscriptions {
+		if !slices.Contains(oldSubscriptions, sub) {
+			subscribe = append(subscribe, sub)
+		}
+	}
+	return unsubscribe, subscribe
+}
+
+// serveConfigJSON serves the configuration in effect as JSON
+func serveConfigJSON(c *gin.Context) {
+	configMutex.RLock()
+	config := currentConfig
+	configMutex.RUnlock()
+
+	c.JSON(http.StatusOK, config)
+}
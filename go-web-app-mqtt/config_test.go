@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"go-mqtt-broker/mqttclient"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr bool
+	}{
+		{"valid", func(c *Config) {}, false},
+		{"all sections", func(c *Config) {
+			c.MQTTProtocolVersion = 5
+			c.Pipeline = &PipelineConfig{Workers: 2, Overflow: overflowSpill}
+			c.Retention = &RetentionConfig{Rules: []RetentionRule{{Topic: "plc/#", KeepRaw: "7d"}}}
+			c.PayloadSchemas = []PayloadSchema{{Topic: "plc/+/data", Fields: []SchemaField{{Name: "temp", Path: "t", Type: "float"}}}}
+		}, false},
+		{"port 0", func(c *Config) { c.WebAppPort = 0 }, true},
+		{"port too high", func(c *Config) { c.WebAppPort = 65536 }, true},
+		{"no broker", func(c *Config) { c.MQTTBrokerURL = "" }, true},
+		{"invalid topic", func(c *Config) { c.MQTTTopics = []Subscription{{Topic: "plc/#/temp"}} }, true},
+		{"qos 3", func(c *Config) { c.MQTTTopics = []Subscription{{Topic: "plc/#", QoS: 3}} }, true},
+		{"duplicate topic", func(c *Config) { c.MQTTTopics = append(c.MQTTTopics, Subscription{Topic: "plc/#", QoS: 1}) }, true},
+		{"missing CA file", func(c *Config) { c.MQTTTLS = &mqttclient.TLSSettings{CAFile: "missing.pem"} }, true},
+		{"protocol 3", func(c *Config) { c.MQTTProtocolVersion = 3 }, true},
+		{"negative batch size", func(c *Config) { c.DBBatchSize = -1 }, true},
+		{"negative buffer size", func(c *Config) { c.MessageBufferSize = -1 }, true},
+		{"unknown overflow", func(c *Config) { c.Pipeline = &PipelineConfig{Overflow: "drop"} }, true},
+		{"invalid retention", func(c *Config) { c.Retention = &RetentionConfig{CompactionInterval: "often"} }, true},
+		{"invalid schema", func(c *Config) { c.PayloadSchemas = []PayloadSchema{{Topic: "plc/#/data"}} }, true},
+	}
+	for _, test := range tests {
+		config := Config{WebAppPort: 8080, MQTTBrokerURL: "tcp://localhost:1883", MQTTTopics: []Subscription{{Topic: "plc/#"}}}
+		test.change(&config)
+		if err := validateConfig(config); (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestSubscriptionChanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		old, new    []Subscription
+		unsubscribe []string
+		subscribe   []Subscription
+	}{
+		{"unchanged", []Subscription{{"plc/#", 0}, {"line/1", 1}}, []Subscription{{"line/1", 1}, {"plc/#", 0}}, nil, nil},
+		{"added", []Subscription{{"plc/#", 0}}, []Subscription{{"plc/#", 0}, {"line/1", 1}}, nil, []Subscription{{"line/1", 1}}},
+		{"removed", []Subscription{{"plc/#", 0}, {"line/1", 1}}, []Subscription{{"plc/#", 0}}, []string{"line/1"}, nil},
+		{"qos changed", []Subscription{{"plc/#", 0}}, []Subscription{{"plc/#", 2}}, nil, []Subscription{{"plc/#", 2}}},
+		{"replaced", []Subscription{{"plc/#", 0}}, []Subscription{{"line/+", 0}}, []string{"plc/#"}, []Subscription{{"line/+", 0}}},
+		{"from none", nil, []Subscription{{"plc/#", 1}}, nil, []Subscription{{"plc/#", 1}}},
+		{"to none", []Subscription{{"plc/#", 1}, {"line/1", 0}}, nil, []string{"plc/#", "line/1"}, nil},
+	}
+	for _, test := range tests {
+		unsubscribe, subscribe := subscriptionChanges(test.old, test.new)
+		if !slices.Equal(unsubscribe, test.unsubscribe) || !slices.Equal(subscribe, test.subscribe) {
+			t.Errorf("%s: got unsubscribe %v, subscribe %v, want %v, %v", test.name, unsubscribe, subscribe, test.unsubscribe, test.subscribe)
+		}
+	}
+}
+
+func TestApplyConfigWithoutReconnect(t *testing.T) {
+	// Settings that don't touch the connection or the subscriptions take effect
+	// without the MQTT client
+	old := Config{WebAppPort: 8080, MQTTBrokerURL: "tcp://localhost:1883", MQTTTopics: []Subscription{{Topic: "plc/#"}}}
+	config := old
+	config.WebAppPort = 8081
+	config.Retention = &RetentionConfig{Rules: []RetentionRule{{Topic: "plc/#", KeepRaw: "7d"}}}
+	config.PayloadSchemas = []PayloadSchema{{Topic: "plc/+/data", Fields: []SchemaField{{Name: "temp", Path: "t", Type: "float"}}}}
+	currentConfig = old
+	t.Cleanup(func() { currentConfig = Config{} })
+
+	if err := applyConfig(old, config); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(currentConfig, config) {
+		t.Errorf("got config %+v, want %+v", currentConfig, config)
+	}
+}
+
+func TestSaveConfigOmitsMissingSections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	configMutex.Lock()
+	currentConfig = Config{WebAppPort: 8080, MQTTBrokerURL: "tcp://localhost:1883", MQTTClientID: "web"}
+	configMutex.Unlock()
+	t.Cleanup(func() { currentConfig = Config{} })
+
+	if err := saveConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]any
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"pipeline", "retention", "mqtt_tls"} {
+		if _, ok := saved[key]; ok {
+			t.Errorf("saved config has %q, want it left out:\n%s", key, data)
+		}
+	}
+}
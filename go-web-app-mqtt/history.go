@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-mqtt-broker/mqttclient"
+)
+
+const (
+	defaultHistoryLimit = 100   // Rows per page when no limit is given
+	maxHistoryLimit     = 10000 // Upper bound for the limit parameter
+)
+
+// historyQuery holds the filters of a /api/history request
+type historyQuery struct {
+	topics []string  // MQTT topic filters, any of them must match
+	from   time.Time // Inclusive lower bound for received_at
+	to     time.Time // Exclusive upper bound for received_at
+	search string    // Substring the payload must contain
+	after  int64     // Only rows with a greater ID, used for pagination
+	limit  int
+}
+
+// historyPage is the JSON response of /api/history
+type historyPage struct {
+	Messages  []Message `json:"messages"`
+	NextAfter *int64    `json:"next_after"` // Cursor for the next page, null on the last page
+}
+
+// serveHistory returns stored messages filtered by topic, time range and payload substring.
+//
+// Query parameters:
+//
+//	topic   MQTT topic filter, may be repeated (+ and # wildcards are supported)
+//	from    RFC 3339 time or date, inclusive
+//	to      RFC 3339 time or date, exclusive
+//	q       substring the payload must contain
+//	after   message ID to continue from, taken from next_after of the previous page
+//	limit   rows per page
+//	format  json (default) or csv
+func serveHistory(c *gin.Context) {
+	query, err := parseHistoryQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Fetch one extra row to know if there is a next page
+	messages, err := queryHistory(query, query.limit+1)
+	if err != nil {
+		log.Printf("Error querying history: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not query history"})
+		return
+	}
+
+	var nextAfter *int64
+	if len(messages) > query.limit {
+		messages = messages[:query.limit]
+		nextAfter = &messages[len(messages)-1].ID
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, historyPage{Messages: messages, NextAfter: nextAfter})
+	case "csv":
+		if nextAfter != nil {
+			c.Header("X-Next-After", strconv.FormatInt(*nextAfter, 10))
+		}
+		writeHistoryCSV(c, messages)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown format, use json or csv"})
+	}
+}
+
+// parseHistoryQuery reads and validates the query parameters
+func parseHistoryQuery(c *gin.Context) (historyQuery, error) {
+	query := historyQuery{
+		topics: c.QueryArray("topic"),
+		search: c.Query("q"),
+		limit:  defaultHistoryLimit,
+	}
+
+	for _, filter := range query.topics {
+		if err := mqttclient.ValidateFilter(filter); err != nil {
+			return query, err
+		}
+	}
+
+	var err error
+	if value := c.Query("from"); value != "" {
+		if query.from, err = parseTimeParam(value); err != nil {
+			return query, fmt.Errorf("invalid from parameter: %v", err)
+		}
+	}
+	if value := c.Query("to"); value != "" {
+		if query.to, err = parseTimeParam(value); err != nil {
+			return query, fmt.Errorf("invalid to parameter: %v", err)
+		}
+	}
+	if value := c.Query("after"); value != "" {
+		if query.after, err = strconv.ParseInt(value, 10, 64); err != nil || query.after < 0 {
+			return query, fmt.Errorf("invalid after parameter")
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		if query.limit, err = strconv.Atoi(value); err != nil || query.limit < 1 || query.limit > maxHistoryLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit)
+		}
+	}
+	return query, nil
+}
+
+// parseTimeParam accepts an RFC 3339 time or a date, which is taken as midnight UTC
+func parseTimeParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// queryHistory returns up to limit messages matching the query, ordered by ID
+func queryHistory(query historyQuery, limit int) ([]Message, error) {
+	conditions := []string{"id > ?"}
+	args := []any{query.after}
+
+	if len(query.topics) > 0 {
+		condition, topicArgs := topicCondition(query.topics)
+		conditions = append(conditions, condition)
+		args = append(args, topicArgs...)
+	}
+	if !query.from.IsZero() {
+		conditions = append(conditions, "received_at >= ?")
+		args = append(args, query.from.UTC().Format(dbTimeLayout))
+	}
+	if !query.to.IsZero() {
+		conditions = append(conditions, "received_at < ?")
+		args = append(args, query.to.UTC().Format(dbTimeLayout))
+	}
+	if query.search != "" {
+		conditions = append(conditions, "instr(message, ?) > 0")
+		args = append(args, query.search)
+	}
+	args = append(args, limit)
+
+	return queryMessages(`
+	SELECT `+messageColumns+` FROM mqtt_data_received
+	WHERE `+strings.Join(conditions, " AND ")+`
+	ORDER BY id ASC
+	LIMIT ?;
+	`, args...)
+}
+
+// queryRecent returns up to n of the newest messages matching the topic filters, oldest first
+func queryRecent(filters []string, n int) ([]Message, error) {
+	where := ""
+	var args []any
+	if len(filters) > 0 {
+		condition, topicArgs := topicCondition(filters)
+		where = "WHERE " + condition
+		args = topicArgs
+	}
+	args = append(args, n)
+
+	return queryMessages(`
+	SELECT `+messageColumns+` FROM (
+		SELECT `+messageColumns+` FROM mqtt_data_received
+		`+where+`
+		ORDER BY id DESC
+		LIMIT ?
+	) ORDER BY id ASC;
+	`, args...)
+}
+
+// topicCondition returns an SQL condition matching any of the MQTT topic filters
+func topicCondition(filters []string) (string, []any) {
+	var conditions []string
+	var args []any
+	for _, filter := range filters {
+		conditions = append(conditions, "mqtt_match(?, topic)")
+		args = append(args, filter)
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+// Columns of mqtt_data_received read by scanMessage
+const messageColumns = "id, topic, message, payload, encoding, qos, retained, duplicate, message_id, received_at"
+
+// queryMessages runs a query for the messageColumns and loads the fields of the messages
+func queryMessages(query string, args ...any) ([]Message, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, loadFields(messages)
+}
+
+// scanMessage reads a row of messageColumns, binary payloads are base64 encoded
+func scanMessage(rows *sql.Rows) (Message, error) {
+	var m Message
+	var text sql.NullString
+	var payload []byte
+	var encoding string
+	err := rows.Scan(&m.ID, &m.Topic, &text, &payload, &encoding, &m.QoS, &m.Retained, &m.Duplicate, &m.MessageID, &m.ReceivedAt)
+	if err != nil {
+		return m, err
+	}
+	if encoding == dbEncodingBinary {
+		m.Message, m.Encoding = base64.StdEncoding.EncodeToString(payload), encodingBase64
+	} else {
+		m.Message, m.Encoding = text.String, encodingUTF8
+	}
+	return m, nil
+}
+
+// writeHistoryCSV writes the messages as a CSV download
+func writeHistoryCSV(c *gin.Context, messages []Message) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="mqtt_history.csv"`)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "topic", "message", "received_at", "encoding", "qos", "retained", "duplicate", "message_id"})
+	for _, m := range messages {
+		w.Write([]string{
+			strconv.FormatInt(m.ID, 10),
+			m.Topic,
+			m.Message,
+			m.ReceivedAt.Format(dbTimeLayout),
+			m.Encoding,
+			strconv.Itoa(int(m.QoS)),
+			strconv.FormatBool(m.Retained),
+			strconv.FormatBool(m.Duplicate),
+			strconv.Itoa(int(m.MessageID)),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("Error writing CSV: %v", err)
+	}
+}
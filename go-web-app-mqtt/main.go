@@ -1,154 +1,250 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gin-gonic/gin"
-	_ "github.com/mattn/go-sqlite3" // Import SQLite driver
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go-mqtt-broker/mqttclient"
 )
 
 // Config struct to hold the application configuration
 type Config struct {
-	WebAppPort    int      `json:"web_app_port"`
-	MQTTBrokerURL string   `json:"mqtt_broker_url"`
-	MQTTClientID  string   `json:"mqtt_client_id"`
-	MQTTTopics    []string `json:"mqtt_topics"`
+	WebAppPort          int                     `json:"web_app_port"`
+	MQTTBrokerURL       string                  `json:"mqtt_broker_url"`
+	MQTTClientID        string                  `json:"mqtt_client_id"`
+	MQTTTopics          []Subscription          `json:"mqtt_topics"`
+	MQTTTLS             *mqttclient.TLSSettings `json:"mqtt_tls,omitempty"`              // TLS settings for ssl:// and mqtts:// brokers
+	MQTTProtocolVersion int                     `json:"mqtt_protocol_version,omitempty"` // 4 for MQTT 3.1.1, the default, or 5
+	DBQueueSize         int                     `json:"db_queue_size,omitempty"`         // Messages waiting to be written, the pipeline waits when it is full
+	DBBatchSize         int                     `json:"db_batch_size,omitempty"`         // Maximum messages per transaction
+	DBFlushIntervalMS   int                     `json:"db_flush_interval_ms,omitempty"`  // Maximum time a message waits for its batch
+	Pipeline            *PipelineConfig         `json:"pipeline,omitempty"`              // Queues and workers between the MQTT client and the database writer
+	MessageBufferSize   int                     `json:"message_buffer_size,omitempty"`   // Newest messages kept in memory for /messages and /events
+	Retention           *RetentionConfig        `json:"retention,omitempty"`
+	PayloadSchemas      []PayloadSchema         `json:"payload_schemas,omitempty"` // JSON payloads decoded into typed fields
+	UsersFile           string                  `json:"users_file,omitempty"`      // Users and API tokens, authentication is disabled without it
 }
 
+// Message is a received MQTT message as it is kept in memory and served to the frontend.
+// ID is the row ID from the mqtt_data_received table, so clients can use it as a cursor.
+type Message struct {
+	ID         int64             `json:"id"`
+	Topic      string            `json:"topic"`
+	Message    string            `json:"message"`  // Payload, base64 for binary payloads
+	Encoding   string            `json:"encoding"` // utf8 or base64, how the payload is encoded in message
+	QoS        byte              `json:"qos"`
+	Retained   bool              `json:"retained"`
+	Duplicate  bool              `json:"duplicate"`
+	MessageID  uint16            `json:"message_id"` // Packet ID of QoS 1 and 2 messages, 0 for QoS 0
+	ReceivedAt time.Time         `json:"received_at"`
+	Fields     map[string]*Field `json:"fields,omitempty"` // Decoded with the payload schema of the topic
+}
+
+// Encodings of the payload in Message.Message
+const (
+	encodingUTF8   = "utf8"   // The payload as text
+	encodingBase64 = "base64" // Payloads that aren't valid UTF-8, base64 encoded
+)
+
+// Timestamps are stored in UTC with a fixed width, so they sort and compare as text
+const dbTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+const (
+	recentMessageCount = 100  // Messages returned to clients that don't send a cursor
+	maxMessagesPerPoll = 1000 // Upper bound for a single /messages response
+)
+
+// Path of the configuration file, subscriptions changed at runtime are saved to it
+const configFile = "config.json"
+
 var (
-	receivedMessages []string                       // Store all received messages in memory
-	lastSentIndex    int                            // Index to track last sent message
-	db               *sql.DB                        // SQLite database connection
-	messageChan      = make(chan mqtt.Message, 100) // Buffered channel for MQTT messages
-	mutex            sync.RWMutex                   // RWMutex for handling shared resources
+	currentConfig Config             // Configuration in effect, guarded by configMutex
+	configMutex   sync.RWMutex       // RWMutex for the configuration
+	db            *sql.DB            // SQLite database connection
+	mqttClient    *mqttclient.Client // Connected MQTT client, used to publish from the web interface
 )
 
 func main() {
+	// Helper commands for the users file
+	if len(os.Args) > 1 {
+		runUserCommand(os.Args[1:])
+		return
+	}
+
 	// Load configuration
-	config := loadConfig("config.json")
+	config, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	currentConfig = config
+
+	// Load the users of the dashboard
+	if config.UsersFile != "" {
+		if users, err = loadUserStore(config.UsersFile); err != nil {
+			log.Fatalf("Error loading users file: %v", err)
+		}
+		go users.watch()
+	} else {
+		log.Println("WARNING: no users_file configured, the dashboard is open to anyone who can reach it")
+	}
 
 	// Initialize the database
 	initDatabase()
 
-	// Setup MQTT client
-	mqttClient := connectToMQTTBroker(config)
+	// Keep the newest messages in memory and preload them from the database
+	messageBuffer = newMessageRing(config.MessageBufferSize)
+	loadRecentMessages()
 
-	// Subscribe to topics
-	for _, topic := range config.MQTTTopics {
-		subscribeToTopic(mqttClient, topic)
+	// Start the database writer
+	writer = newDBWriter(config.DBQueueSize, config.DBBatchSize, time.Duration(config.DBFlushIntervalMS)*time.Millisecond)
+	go writer.run()
+
+	// Start the workers that process received messages, before the client subscribes
+	if pipe, err = newPipeline(config.Pipeline, processMessage); err != nil {
+		log.Fatalf("Error starting message pipeline: %v", err)
 	}
+	pipe.start()
+
+	// Start the retention job, it returns right away when no rules are configured
+	go runRetention(config.Retention)
 
-	// Start a background goroutine to process messages from the channel
-	go processMessages()
+	// Setup MQTT client, it subscribes to the topics when it connects
+	mqttClient, err = connectToMQTTBroker(config)
+	if err != nil {
+		log.Fatalf("Error connecting to MQTT broker: %v", err)
+	}
+
+	// Apply changes to config.json without a restart
+	go watchConfig(configFile)
 
 	// Start the web server
 	startWebServer(config.WebAppPort)
 }
 
-// Load the configuration from config.json
-func loadConfig(filePath string) Config {
-	file, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		log.Fatalf("Error reading config file: %v", err)
-	}
-
-	var config Config
-	err = json.Unmarshal(file, &config)
-	if err != nil {
-		log.Fatalf("Error parsing config file: %v", err)
-	}
-	return config
+// Register the SQLite driver with an mqtt_match(filter, topic) function,
+// so queries can filter topics with MQTT wildcards, and an mqtt_number(payload)
+// function that returns the value of numeric payloads
+func init() {
+	sql.Register("sqlite3_mqtt", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("mqtt_match", mqttclient.Match, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("mqtt_number", parseNumber, true)
+		},
+	})
 }
 
 // Initialize the SQLite database and create the table if it doesn't exist
 func initDatabase() {
 	var err error
-	db, err = sql.Open("sqlite3", "./mqtt_data.db")
+	// WAL lets the web server read while the writer inserts, the busy timeout
+	// makes connections wait for a lock instead of failing with SQLITE_BUSY.
+	// Transactions take the write lock when they begin, so a transaction that
+	// reads before it writes can't fail on a snapshot that another one changed.
+	db, err = sql.Open("sqlite3_mqtt", "file:mqtt_data.db?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL&_txlock=immediate")
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
 
-	// Create the table if it doesn't exist
-	createTableQuery := `
-	CREATE TABLE IF NOT EXISTS mqtt_data_received (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		topic TEXT,
-		message TEXT,
-		received_at DATETIME
-	);
-	`
+	// A new database gets the current schema, older ones the tables they miss
+	if err := createSchema(); err != nil {
+		log.Fatalf("Error creating tables: %v", err)
+	}
 
-	_, err = db.Exec(createTableQuery)
-	if err != nil {
-		log.Fatalf("Error creating table: %v", err)
+	// Bring the schema of older databases up to date
+	if err := migrateDatabase(); err != nil {
+		log.Fatalf("Error migrating database: %v", err)
 	}
 
 	fmt.Println("Database and table initialized.")
 }
 
-// Save the MQTT message into the database (run this in a separate goroutine)
-func saveMessageToDB(topic string, message string) {
-	insertQuery := `
-	INSERT INTO mqtt_data_received (topic, message, received_at)
-	VALUES (?, ?, ?);
-	`
-
-	_, err := db.Exec(insertQuery, topic, message, time.Now().Format(time.RFC3339))
+// Load the last messages from the database into the ring, so a fresh page load shows some history
+func loadRecentMessages() {
+	messages, err := queryRecent(nil, len(messageBuffer.records))
 	if err != nil {
-		log.Printf("Error inserting message into database: %v", err)
+		log.Printf("Error loading recent messages: %v", err)
+		return
 	}
+	messageBuffer.add(messages...)
 }
 
 // Connect to the MQTT broker
-func connectToMQTTBroker(config Config) mqtt.Client {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(config.MQTTBrokerURL)
-	opts.SetClientID(config.MQTTClientID)
-
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("Error connecting to MQTT broker: %v", token.Error())
+func connectToMQTTBroker(config Config) (*mqttclient.Client, error) {
+	client, err := mqttclient.New(config.MQTTBrokerURL,
+		mqttclient.WithClientID(config.MQTTClientID),
+		mqttclient.WithTLSSettings(config.MQTTTLS),
+		mqttclient.WithProtocolVersion(cmp.Or(config.MQTTProtocolVersion, 4)),
+		// The session is clean, so subscribe again every time the client (re)connects
+		mqttclient.WithOnConnect(countReconnects(subscribeAll)),
+		mqttclient.WithOnConnectionLost(func(client *mqttclient.Client, d mqttclient.Disconnect) {
+			log.Printf("Connection to MQTT broker lost: %v", d)
+			mqttConnectionsLost.WithLabelValues(d.Reason.String()).Inc()
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Connect(context.Background()); err != nil {
+		return nil, err
 	}
 	fmt.Println("Connected to MQTT broker:", config.MQTTBrokerURL)
-	return client
+	return client, nil
 }
 
-// Subscribe to the MQTT topics and handle incoming messages
-func subscribeToTopic(client mqtt.Client, topic string) {
-	token := client.Subscribe(topic, 0, func(client mqtt.Client, msg mqtt.Message) {
-		// Pass the received message to the channel
-		messageChan <- msg
-	})
-	token.Wait()
-	if token.Error() != nil {
-		log.Fatalf("Error subscribing to topic %s: %v", topic, token.Error())
+// subscribeAll subscribes the client to the topics of the config in effect
+func subscribeAll(client *mqttclient.Client) {
+	configMutex.RLock()
+	subscriptions := slices.Clone(currentConfig.MQTTTopics)
+	configMutex.RUnlock()
+
+	for _, sub := range subscriptions {
+		if err := subscribeToTopic(context.Background(), client, sub); err != nil {
+			log.Printf("Error subscribing to topic %s: %v", sub.Topic, err)
+		}
 	}
-	fmt.Println("Subscribed to topic:", topic)
 }
 
-// Process messages from the channel in the background
-func processMessages() {
-	for msg := range messageChan {
-		messageContent := fmt.Sprintf("Topic: %s, Message: %s", msg.Topic(), string(msg.Payload()))
+// processMessage is run by the pipeline workers for every received message
+func processMessage(m inboundMessage) {
+	configMutex.RLock()
+	schemas := currentConfig.PayloadSchemas
+	configMutex.RUnlock()
+
+	message := Message{
+		Topic:      m.Topic,
+		QoS:        m.QoS,
+		Retained:   m.Retained,
+		Duplicate:  m.Duplicate,
+		MessageID:  m.MessageID,
+		ReceivedAt: m.ReceivedAt,
+	}
+	message.Message, message.Encoding = encodePayload(m.Payload)
 
-		// Append the message to the receivedMessages slice in a thread-safe way
-		mutex.Lock()
-		receivedMessages = append(receivedMessages, messageContent)
-		mutex.Unlock()
+	// Decode the fields of JSON payloads with a schema
+	if schema := findPayloadSchema(schemas, message.Topic); schema != nil {
+		message.Fields = decodePayload(schema, m.Payload)
+	}
 
-		// Save the message to the database (non-blocking)
-		go saveMessageToDB(msg.Topic(), string(msg.Payload()))
+	// Queue the message for the database writer, which assigns the message ID
+	// and passes the message on to the frontend once it is stored. When the
+	// writer falls behind, this waits and the pipeline applies its overflow policy.
+	writer.enqueue(message)
 
-		fmt.Printf("Processed message from topic %s: %s\n", msg.Topic(), string(msg.Payload()))
-	}
+	fmt.Printf("Processed message from topic %s: %s\n", m.Topic, message.Message)
 }
 
 // Start the web server to serve the frontend and messages
@@ -160,47 +256,85 @@ func startWebServer(port int) {
 
 	router.LoadHTMLGlob("templates/*")
 
+	// Log in and out, these pages are open to everyone
+	router.GET("/login", serveLogin)
+	router.POST("/login", login)
+	router.POST("/logout", logout)
+
+	// Everything else needs a login or an API token, the role decides what is allowed
+	viewer := router.Group("/", authenticate, requireRole(roleViewer))
+	publisher := viewer.Group("/", requireRole(rolePublisher))
+	admin := viewer.Group("/", requireRole(roleAdmin))
+
 	// Serve the index.html page
-	router.GET("/", func(c *gin.Context) {
+	viewer.GET("/", func(c *gin.Context) {
 		c.HTML(http.StatusOK, "index.html", nil)
 	})
 
-	// Serve config.json as a JSON response via the /config endpoint
-	router.GET("/config", serveConfigJSON)
+	// Name and role of the logged in user, so the page can hide what the user can't do
+	viewer.GET("/api/me", serveMe)
+
+	// Serve the configuration in effect, it contains the broker URL
+	admin.GET("/config", serveConfigJSON)
 
-	// Serve only new messages as JSON
-	router.GET("/messages", func(c *gin.Context) {
-		mutex.RLock()                            // Use RLock to allow concurrent reads
-		data := receivedMessages[lastSentIndex:] // Get only new messages since lastSentIndex
-		lastSentIndex = len(receivedMessages)    // Update lastSentIndex to the current message count
-		mutex.RUnlock()
+	// Serve messages as JSON, each client keeps its own cursor
+	viewer.GET("/messages", serveMessages)
 
-		c.JSON(http.StatusOK, data)
+	// Push new messages to the browser as they are processed
+	viewer.GET("/events", serveEvents)
+
+	// Query the messages stored in the database
+	viewer.GET("/api/history", serveHistory)
+
+	// Query the values decoded from the payloads
+	viewer.GET("/api/values", serveValues)
+
+	// Aggregate numeric data into time buckets for the charts
+	viewer.GET("/api/series", serveSeries)
+
+	// Publish messages and send requests from the web interface
+	publisher.POST("/api/publish", servePublish)
+	publisher.POST("/api/request", serveRequest)
+
+	// Manage the subscriptions at runtime
+	viewer.GET("/api/subscriptions", serveSubscriptions)
+	admin.POST("/api/subscriptions", addSubscription)
+	admin.DELETE("/api/subscriptions", removeSubscription)
+
+	// Serve runtime metrics as JSON
+	viewer.GET("/api/stats", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"pipeline": pipe.stats(), "db_writer": writer.stats()})
 	})
 
+	// Serve the metrics for Prometheus, scrape them with an API token
+	viewer.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
 	addr := fmt.Sprintf(":%d", port)
 	router.Run(addr)
 }
 
-// serveConfigJSON reads the config.json file and serves it as JSON
-func serveConfigJSON(c *gin.Context) {
-	// Read the config.json file from the root directory
-	file, err := ioutil.ReadFile("config.json")
-	if err != nil {
-		log.Fatalf("Error reading config.json: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read config file"})
-		return
+// serveMessages returns the messages received after the ID given in the "after" query
+// parameter. Without a cursor the most recent messages are returned, so every browser
+// tab can follow the complete stream on its own. One or more "topic" parameters limit
+// the response to topics matching those MQTT filters.
+func serveMessages(c *gin.Context) {
+	filters := c.QueryArray("topic")
+	for _, filter := range filters {
+		if err := mqttclient.ValidateFilter(filter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
 
-	// Unmarshal the JSON file into the Config struct
-	var config Config
-	err = json.Unmarshal(file, &config)
-	if err != nil {
-		log.Fatalf("Error unmarshalling config.json: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid config format"})
+	value := c.Query("after")
+	if value == "" {
+		c.JSON(http.StatusOK, recentMessages(filters, recentMessageCount))
 		return
 	}
-
-	// Serve the config as JSON
-	c.JSON(http.StatusOK, config)
+	after, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || after < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid after parameter"})
+		return
+	}
+	c.JSON(http.StatusOK, messagesAfter(after, filters, maxMessagesPerPoll))
 }
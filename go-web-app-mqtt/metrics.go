@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go-mqtt-broker/mqttclient"
+)
+
+// Prometheus metrics, served on /metrics together with the Go runtime metrics
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_web_messages_received_total",
+		Help: "MQTT messages received, by topic.",
+	}, []string{"topic"})
+
+	lastMessageTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_web_last_message_timestamp_seconds",
+		Help: "Unix time of the last received MQTT message.",
+	})
+
+	dbInsertDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mqtt_web_db_insert_duration_seconds",
+		Help:    "Time to insert a batch of messages into the database.",
+		Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	})
+
+	dbInsertErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_web_db_insert_errors_total",
+		Help: "Batches that could not be written to the database.",
+	})
+
+	mqttConnectionsLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_web_mqtt_connections_lost_total",
+		Help: "Times the connection to the MQTT broker was lost, by reason.",
+	}, []string{"reason"})
+
+	mqttReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_web_mqtt_reconnects_total",
+		Help: "Times the client connected to the MQTT broker again after losing the connection.",
+	})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mqtt_web_mqtt_connected",
+		Help: "1 when the client is connected to the MQTT broker, 0 otherwise.",
+	}, func() float64 {
+		if client := currentMQTTClient(); client != nil && client.IsConnected() {
+			return 1
+		}
+		return 0
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mqtt_web_message_queue_depth",
+		Help: "Received messages waiting in memory to be processed.",
+	}, func() float64 { return float64(pipe.stats().QueueDepth) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mqtt_web_message_queue_capacity",
+		Help: "Size of the received message queues of all workers.",
+	}, func() float64 { return float64(pipe.stats().QueueCapacity) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mqtt_web_messages_spilled",
+		Help: "Received messages waiting in the spill files.",
+	}, func() float64 { return float64(pipe.stats().Spilled) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "mqtt_web_messages_dropped_total",
+		Help: "Messages dropped by the overflow policy of the pipeline.",
+	}, func() float64 { return float64(pipe.dropped.Load()) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mqtt_web_db_queue_depth",
+		Help: "Messages waiting to be written to the database.",
+	}, func() float64 { return float64(writer.stats().QueueDepth) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mqtt_web_db_queue_capacity",
+		Help: "Size of the database queue, the pipeline workers wait when it is full.",
+	}, func() float64 { return float64(writer.stats().QueueCapacity) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "mqtt_web_messages_written_total",
+		Help: "Messages written to the database.",
+	}, func() float64 { return float64(writer.written.Load()) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "mqtt_web_messages_failed_total",
+		Help: "Messages lost because their batch could not be written to the database.",
+	}, func() float64 { return float64(writer.failed.Load()) })
+}
+
+// countReconnects returns an OnConnect handler that counts every connection
+// after the first one as a reconnect before calling next
+func countReconnects(next func(*mqttclient.Client)) func(*mqttclient.Client) {
+	var connected atomic.Bool
+	return func(client *mqttclient.Client) {
+		if connected.Swap(true) {
+			mqttReconnects.Inc()
+		}
+		next(client)
+	}
+}
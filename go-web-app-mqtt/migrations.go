@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migration is a change of the database schema. Migrations run in order, each
+// in its own transaction, and the number of applied migrations is kept in
+// PRAGMA user_version, so every migration runs exactly once per database.
+type migration struct {
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// baselineSchema is the schema the migrations start from. Databases of older
+// versions may miss some of its tables, they are created before migrating.
+// value_num has NUMERIC affinity so integers are stored exactly.
+const baselineSchema = `
+CREATE TABLE IF NOT EXISTS mqtt_data_received (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic TEXT,
+	message TEXT,
+	received_at DATETIME
+);
+CREATE TABLE IF NOT EXISTS mqtt_data_downsampled (
+	topic TEXT NOT NULL,
+	bucket_start DATETIME NOT NULL,
+	bucket_seconds INTEGER NOT NULL,
+	message_count INTEGER NOT NULL,
+	value_count INTEGER NOT NULL,
+	min_value REAL,
+	max_value REAL,
+	value_sum REAL,
+	PRIMARY KEY (topic, bucket_seconds, bucket_start)
+);
+` + valuesSchema
+
+// currentSchema is the schema after all migrations, new databases start with it.
+// Keep it in sync with the migrations, TestMigrations compares the two.
+const currentSchema = `
+CREATE TABLE mqtt_data_received (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic TEXT,
+	message TEXT,
+	received_at DATETIME,
+	qos INTEGER NOT NULL DEFAULT 0,
+	retained INTEGER NOT NULL DEFAULT 0,
+	duplicate INTEGER NOT NULL DEFAULT 0,
+	message_id INTEGER NOT NULL DEFAULT 0,
+	payload BLOB,
+	encoding TEXT NOT NULL DEFAULT 'utf8'
+);
+CREATE TABLE mqtt_data_downsampled (
+	topic TEXT NOT NULL,
+	field TEXT NOT NULL DEFAULT '',
+	bucket_start DATETIME NOT NULL,
+	bucket_seconds INTEGER NOT NULL,
+	message_count INTEGER NOT NULL,
+	value_count INTEGER NOT NULL,
+	min_value REAL,
+	max_value REAL,
+	value_sum REAL,
+	unit TEXT,
+	PRIMARY KEY (topic, field, bucket_seconds, bucket_start)
+);
+` + valuesSchema
+
+// valuesSchema holds the values decoded with the payload schemas and the indexes
+// for the history queries, no migration changed them yet
+const valuesSchema = `
+CREATE TABLE IF NOT EXISTS mqtt_data_values (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	message_id INTEGER NOT NULL,
+	topic TEXT NOT NULL,
+	field TEXT NOT NULL,
+	item INTEGER,
+	value_type TEXT NOT NULL,
+	value_num NUMERIC,
+	value_text TEXT,
+	unit TEXT,
+	received_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_mqtt_data_values_message_id ON mqtt_data_values (message_id);
+CREATE INDEX IF NOT EXISTS idx_mqtt_data_values_field ON mqtt_data_values (field, received_at);
+CREATE INDEX IF NOT EXISTS idx_mqtt_data_received_received_at ON mqtt_data_received (received_at);
+CREATE INDEX IF NOT EXISTS idx_mqtt_data_received_topic ON mqtt_data_received (topic);
+`
+
+// Migrations are only ever appended, never changed or reordered
+var migrations = []migration{
+	{
+		// Older versions stored local times with an offset, convert them to the UTC layout
+		description: "convert timestamps to UTC",
+		apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			UPDATE mqtt_data_received
+			SET received_at = strftime('%Y-%m-%dT%H:%M:%fZ', received_at)
+			WHERE received_at NOT LIKE '____-__-__T__:__:__.___Z';
+			`)
+			return err
+		},
+	},
+	{
+		// Payloads that aren't valid UTF-8 are stored in payload with encoding 'binary'
+		// and message NULL, text payloads stay in message for search, charts and retention
+		description: "add message metadata and binary payloads",
+		apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			ALTER TABLE mqtt_data_received ADD COLUMN qos INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE mqtt_data_received ADD COLUMN retained INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE mqtt_data_received ADD COLUMN duplicate INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE mqtt_data_received ADD COLUMN message_id INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE mqtt_data_received ADD COLUMN payload BLOB;
+			ALTER TABLE mqtt_data_received ADD COLUMN encoding TEXT NOT NULL DEFAULT 'utf8';
+			`)
+			return err
+		},
+	},
+	{
+		// Retention also downsamples the numeric decoded fields, the payload buckets
+		// get an empty field. SQLite can't change a primary key, so the table is rebuilt.
+		description: "add fields to downsampled buckets",
+		apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE mqtt_data_downsampled_new (
+				topic TEXT NOT NULL,
+				field TEXT NOT NULL DEFAULT '',
+				bucket_start DATETIME NOT NULL,
+				bucket_seconds INTEGER NOT NULL,
+				message_count INTEGER NOT NULL,
+				value_count INTEGER NOT NULL,
+				min_value REAL,
+				max_value REAL,
+				value_sum REAL,
+				unit TEXT,
+				PRIMARY KEY (topic, field, bucket_seconds, bucket_start)
+			);
+			INSERT INTO mqtt_data_downsampled_new (topic, bucket_start, bucket_seconds, message_count, value_count, min_value, max_value, value_sum)
+			SELECT topic, bucket_start, bucket_seconds, message_count, value_count, min_value, max_value, value_sum FROM mqtt_data_downsampled;
+			DROP TABLE mqtt_data_downsampled;
+			ALTER TABLE mqtt_data_downsampled_new RENAME TO mqtt_data_downsampled;
+			`)
+			return err
+		},
+	},
+}
+
+// createSchema creates the current schema in a new database and marks all
+// migrations as applied. Older databases get the baseline tables they miss,
+// migrateDatabase brings them up to date.
+func createSchema() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var tables int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'mqtt_data_received';`).Scan(&tables); err != nil {
+		return err
+	}
+	if tables > 0 {
+		if _, err := tx.Exec(baselineSchema); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if _, err := tx.Exec(currentSchema); err != nil {
+		return err
+	}
+	// PRAGMA doesn't take parameters, the version is the number of migrations
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", len(migrations))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateDatabase applies the migrations the database doesn't have yet
+func migrateDatabase() error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version;").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this app (%d), use a newer version of the app", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if err := applyMigration(i+1, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", i+1, migrations[i].description, err)
+		}
+		log.Printf("Applied database migration %d: %s", i+1, migrations[i].description)
+	}
+	return nil
+}
+
+// applyMigration runs a migration and sets the schema version in one transaction
+func applyMigration(version int, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.apply(tx); err != nil {
+		return err
+	}
+	// PRAGMA doesn't take parameters, version is a number from the loop
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+)
+
+// Schema of the first versions, before the downsampled and values tables
+const oldSchema = `
+CREATE TABLE mqtt_data_received (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic TEXT,
+	message TEXT,
+	received_at DATETIME
+);
+INSERT INTO mqtt_data_received (topic, message, received_at) VALUES ('plc/1', '21.5', '2024-09-06 14:00:00+02:00');
+INSERT INTO mqtt_data_received (topic, message, received_at) VALUES ('plc/1', '22', '2024-09-06T12:01:00.000Z');
+`
+
+// openOldDatabase creates a database with the schema in a temporary directory
+// and opens it like the app does
+func openOldDatabase(t *testing.T, schema string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	old, err := sql.Open("sqlite3_mqtt", "mqtt_data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(schema)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initDatabase()
+	t.Cleanup(func() { db.Close() })
+}
+
+// schemaOf returns the columns of every table and the names of the indexes
+func schemaOf(t *testing.T) []string {
+	t.Helper()
+	var schema []string
+	tables, err := db.Query(`SELECT type, name FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY type, name;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tables.Close()
+	for tables.Next() {
+		var kind, name string
+		if err := tables.Scan(&kind, &name); err != nil {
+			t.Fatal(err)
+		}
+		schema = append(schema, kind+" "+name)
+	}
+	for _, entry := range slices.Clone(schema) {
+		var kind, name string
+		fmt.Sscan(entry, &kind, &name)
+		if kind != "table" {
+			continue
+		}
+		columns, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s);", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for columns.Next() {
+			var cid, notNull, pk int
+			var column, columnType string
+			var defaultValue sql.NullString
+			if err := columns.Scan(&cid, &column, &columnType, &notNull, &defaultValue, &pk); err != nil {
+				t.Fatal(err)
+			}
+			schema = append(schema, fmt.Sprintf("%s.%s %s not null %d default %v pk %d", name, column, columnType, notNull, defaultValue, pk))
+		}
+		columns.Close()
+	}
+	return schema
+}
+
+func schemaVersion(t *testing.T) int {
+	t.Helper()
+	var version int
+	if err := db.QueryRow("PRAGMA user_version;").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrations(t *testing.T) {
+	// A new database starts with the current schema
+	openTestDatabase(t)
+	if version := schemaVersion(t); version != len(migrations) {
+		t.Errorf("got version %d for a new database, want %d", version, len(migrations))
+	}
+	current := schemaOf(t)
+	db.Close()
+
+	// An old database is migrated to the same schema
+	openOldDatabase(t, oldSchema)
+
+	if version := schemaVersion(t); version != len(migrations) {
+		t.Errorf("got version %d after migrating, want %d", version, len(migrations))
+	}
+	if migrated := schemaOf(t); !slices.Equal(migrated, current) {
+		t.Errorf("the migrated schema differs from the schema of a new database\nmigrated: %q\nnew:      %q", migrated, current)
+	}
+
+	// The old messages are kept, with UTC timestamps and the default metadata
+	rows, err := db.Query(`SELECT CAST(received_at AS TEXT), encoding, qos FROM mqtt_data_received ORDER BY id;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var receivedAt, encoding string
+		var qos int
+		if err := rows.Scan(&receivedAt, &encoding, &qos); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %s %d", receivedAt, encoding, qos))
+	}
+	want := []string{"2024-09-06T12:00:00.000Z utf8 0", "2024-09-06T12:01:00.000Z utf8 0"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got messages %q, want %q", got, want)
+	}
+}
+
+func TestMigrationsKeepDownsampledBuckets(t *testing.T) {
+	// A database with the downsampled table of the retention rules, but no migrations
+	openOldDatabase(t, oldSchema+baselineSchema+`
+	INSERT INTO mqtt_data_downsampled (topic, bucket_start, bucket_seconds, message_count, value_count, min_value, max_value, value_sum)
+	VALUES ('plc/1', '2024-09-06T12:00:00.000Z', 60, 2, 2, 21.5, 22, 43.5);
+	`)
+
+	var field string
+	var sum float64
+	if err := db.QueryRow(`SELECT field, value_sum FROM mqtt_data_downsampled WHERE topic = 'plc/1';`).Scan(&field, &sum); err != nil {
+		t.Fatal(err)
+	}
+	if field != "" || sum != 43.5 {
+		t.Errorf("got bucket with field %q and sum %v, want the payload bucket with sum 43.5", field, sum)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-mqtt-broker/mqttclient"
+)
+
+// Defaults for the pipeline when config.json doesn't set them
+const (
+	defaultPipelineWorkers   = 4
+	defaultPipelineQueueSize = 1000
+	defaultPipelineOverflow  = overflowDropOldest
+	defaultPipelineSpillDir  = "spill"
+)
+
+// What the pipeline does with a message when the queue of its worker is full
+const (
+	overflowBlock      = "block"       // Wait for space, this holds up the MQTT client
+	overflowDropOldest = "drop_oldest" // Drop the oldest queued message
+	overflowDropNewest = "drop_newest" // Drop the new message
+	overflowSpill      = "spill"       // Append the message to a file on disk
+)
+
+// How often drops are logged at most, the counters have the exact numbers
+const dropLogInterval = time.Minute
+
+// How long a worker waits before it reads from its spill file again after an error
+const spillRetryDelay = time.Second
+
+// PipelineConfig configures how received messages are queued and processed
+type PipelineConfig struct {
+	Workers   int    `json:"workers,omitempty"`    // Goroutines processing messages, each topic always goes to the same one
+	QueueSize int    `json:"queue_size,omitempty"` // Messages held in memory, split evenly across the workers
+	Overflow  string `json:"overflow,omitempty"`   // block, drop_oldest, drop_newest or spill
+	SpillDir  string `json:"spill_dir,omitempty"`  // Directory of the spill files
+}
+
+// inboundMessage is a received MQTT message on its way to the database writer
+type inboundMessage struct {
+	Topic      string    `json:"topic"`
+	Payload    []byte    `json:"payload"`
+	QoS        byte      `json:"qos"`
+	Retained   bool      `json:"retained"`
+	Duplicate  bool      `json:"duplicate"`
+	MessageID  uint16    `json:"message_id"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// pipeline takes messages from the MQTT client without blocking it and hands them
+// to a pool of workers. Messages of a topic always go to the same worker, so they
+// are processed in the order they arrived.
+type pipeline struct {
+	shards    []*pipelineShard
+	shardSize int
+	overflow  string
+	handle    func(inboundMessage)
+
+	received   atomic.Int64 // Messages received from the MQTT client
+	dropped    atomic.Int64 // Messages dropped by the overflow policy or because they couldn't be spilled
+	lastLogged atomic.Int64 // Unix time of the last drop log line
+}
+
+// pipelineShard is the queue of one worker
+type pipelineShard struct {
+	mutex     sync.Mutex
+	notEmpty  *sync.Cond
+	notFull   *sync.Cond
+	queue     []inboundMessage // Oldest first
+	spill     *spillFile       // Only with the spill policy, holds messages newer than the queue
+	unhandled int              // Messages at the front of the queue that were read from the spill file
+}
+
+// pipelineStats is a snapshot of the pipeline metrics
+type pipelineStats struct {
+	Workers       int    `json:"workers"`
+	Overflow      string `json:"overflow"`
+	QueueDepth    int    `json:"queue_depth"`
+	QueueCapacity int    `json:"queue_capacity"`
+	Spilled       int    `json:"spilled"`
+	Received      int64  `json:"received"`
+	Dropped       int64  `json:"dropped"`
+}
+
+var pipe *pipeline
+
+// validatePipelineConfig checks the pipeline settings, zero values and a missing
+// section are allowed for the defaults
+func validatePipelineConfig(config *PipelineConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.Workers < 0 || config.QueueSize < 0 {
+		return fmt.Errorf("workers and queue_size can't be negative")
+	}
+	switch config.Overflow {
+	case "", overflowBlock, overflowDropOldest, overflowDropNewest, overflowSpill:
+	default:
+		return fmt.Errorf("overflow must be block, drop_oldest, drop_newest or spill")
+	}
+	return nil
+}
+
+// newPipeline creates the pipeline and opens the spill files, which may hold
+// messages from the last run. Without settings it uses the defaults.
+func newPipeline(settings *PipelineConfig, handle func(inboundMessage)) (*pipeline, error) {
+	var config PipelineConfig
+	if settings != nil {
+		config = *settings
+	}
+	if config.Workers == 0 {
+		config.Workers = defaultPipelineWorkers
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = defaultPipelineQueueSize
+	}
+	if config.Overflow == "" {
+		config.Overflow = defaultPipelineOverflow
+	}
+	if config.SpillDir == "" {
+		config.SpillDir = defaultPipelineSpillDir
+	}
+
+	p := &pipeline{
+		shardSize: max(config.QueueSize/config.Workers, 1),
+		overflow:  config.Overflow,
+		handle:    handle,
+	}
+	if config.Overflow == overflowSpill {
+		if err := os.MkdirAll(config.SpillDir, 0755); err != nil {
+			return nil, err
+		}
+		warnAboutOrphanedSpillFiles(config.SpillDir, config.Workers)
+	}
+	for i := 0; i < config.Workers; i++ {
+		s := &pipelineShard{}
+		s.notEmpty = sync.NewCond(&s.mutex)
+		s.notFull = sync.NewCond(&s.mutex)
+		if config.Overflow == overflowSpill {
+			var err error
+			if s.spill, err = openSpillFile(spillFilePath(config.SpillDir, i)); err != nil {
+				return nil, err
+			}
+			if s.spill.count > 0 {
+				log.Printf("Resuming %d spilled messages from %s", s.spill.count, s.spill.path)
+			}
+		}
+		p.shards = append(p.shards, s)
+	}
+	return p, nil
+}
+
+// start starts the workers
+func (p *pipeline) start() {
+	for _, s := range p.shards {
+		go p.work(s)
+	}
+}
+
+// push queues a message for its worker. It only blocks with the block policy.
+func (p *pipeline) push(m inboundMessage) {
+	p.received.Add(1)
+
+	h := fnv.New32a()
+	h.Write([]byte(m.Topic))
+	s := p.shards[h.Sum32()%uint32(len(p.shards))]
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Once messages are spilled, newer ones follow them to the file to keep the order
+	if s.spill != nil && (s.spill.count > 0 || len(s.queue) >= p.shardSize) {
+		if err := s.spill.append(m); err != nil {
+			p.drop(fmt.Sprintf("can't write to spill file: %v", err))
+			return
+		}
+		s.notEmpty.Signal()
+		return
+	}
+
+	if len(s.queue) >= p.shardSize {
+		switch p.overflow {
+		case overflowBlock:
+			for len(s.queue) >= p.shardSize {
+				s.notFull.Wait()
+			}
+		case overflowDropOldest:
+			s.queue[0] = inboundMessage{} // Release the payload
+			s.queue = s.queue[1:]
+			p.drop("dropping the oldest messages")
+		default:
+			p.drop("dropping new messages")
+			return
+		}
+	}
+	s.queue = append(s.queue, m)
+	s.notEmpty.Signal()
+}
+
+// work processes the messages of a shard one at a time. Spilled messages are
+// read back in batches once the queue is empty, the file is only truncated after
+// all of them are handled, so a crash doesn't lose the batch in memory.
+func (p *pipeline) work(s *pipelineShard) {
+	for {
+		s.mutex.Lock()
+		if s.spill != nil && s.spill.count == 0 && s.unhandled == 0 && s.spill.used {
+			if err := s.spill.reset(); err != nil {
+				log.Printf("Error truncating spill file %s: %v", s.spill.path, err)
+			}
+		}
+		for len(s.queue) == 0 && (s.spill == nil || s.spill.count == 0) {
+			s.notEmpty.Wait()
+		}
+		if len(s.queue) == 0 {
+			// Only this worker reads the file. The count stays up until the lines
+			// are read, so push keeps appending new messages behind them.
+			n := min(p.shardSize, s.spill.count)
+			s.mutex.Unlock()
+			messages, lines, err := s.spill.read(n)
+			s.mutex.Lock()
+
+			s.spill.count -= lines
+			s.queue = messages
+			s.unhandled = len(messages)
+			if len(s.queue) == 0 {
+				s.mutex.Unlock()
+				if err != nil {
+					log.Printf("Error reading spill file %s, trying again in %s: %v", s.spill.path, spillRetryDelay, err)
+					time.Sleep(spillRetryDelay)
+				}
+				continue
+			}
+			if err != nil {
+				log.Printf("Error reading spill file %s: %v", s.spill.path, err)
+			}
+		}
+		m := s.queue[0]
+		s.queue[0] = inboundMessage{}
+		s.queue = s.queue[1:]
+		s.notFull.Signal()
+		s.mutex.Unlock()
+
+		p.handle(m)
+
+		// The message is handled, it may go from the spill file now
+		s.mutex.Lock()
+		if s.unhandled > 0 {
+			s.unhandled--
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// drop counts a dropped message and logs the reason, at most once per dropLogInterval
+func (p *pipeline) drop(reason string) {
+	dropped := p.dropped.Add(1)
+	now := time.Now().Unix()
+	last := p.lastLogged.Load()
+	if now-last >= int64(dropLogInterval/time.Second) && p.lastLogged.CompareAndSwap(last, now) {
+		log.Printf("Message queue is full, %s (%d dropped so far)", reason, dropped)
+	}
+}
+
+// stats returns the current pipeline metrics
+func (p *pipeline) stats() pipelineStats {
+	stats := pipelineStats{
+		Workers:       len(p.shards),
+		Overflow:      p.overflow,
+		QueueCapacity: p.shardSize * len(p.shards),
+		Received:      p.received.Load(),
+		Dropped:       p.dropped.Load(),
+	}
+	for _, s := range p.shards {
+		s.mutex.Lock()
+		stats.QueueDepth += len(s.queue)
+		if s.spill != nil {
+			stats.Spilled += s.spill.count
+		}
+		s.mutex.Unlock()
+	}
+	return stats
+}
+
+// newInboundMessage copies a message from the MQTT client
+func newInboundMessage(msg mqttclient.Message) inboundMessage {
+	return inboundMessage{
+		Topic:      msg.Topic,
+		Payload:    msg.Payload,
+		QoS:        msg.QoS,
+		Retained:   msg.Retained,
+		Duplicate:  msg.Duplicate,
+		MessageID:  msg.MessageID,
+		ReceivedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+}
+
+// spillFile is an append-only file of JSON lines holding the messages of a shard
+// that didn't fit in memory. It is truncated once all messages are read back and
+// handled. The shard mutex guards count and used, the reader is only used by the
+// worker of the shard.
+type spillFile struct {
+	path   string
+	file   *os.File // Opened for appending
+	reader *bufio.Reader
+	input  *os.File // Opened for reading, at the oldest unread message
+	count  int      // Unread messages
+	used   bool     // The file has lines, read or unread
+}
+
+// spillFilePath returns the path of the spill file of a worker
+func spillFilePath(dir string, worker int) string {
+	return filepath.Join(dir, fmt.Sprintf("worker-%d.jsonl", worker))
+}
+
+// warnAboutOrphanedSpillFiles logs spill files of workers that no longer exist,
+// which happens when workers is lowered while messages are spilled
+func warnAboutOrphanedSpillFiles(dir string, workers int) {
+	files, _ := filepath.Glob(filepath.Join(dir, "worker-*.jsonl"))
+	for _, file := range files {
+		var worker int
+		if _, err := fmt.Sscanf(filepath.Base(file), "worker-%d.jsonl", &worker); err == nil && worker >= workers {
+			log.Printf("WARNING: %s belongs to a worker that no longer exists, its messages are not processed", file)
+		}
+	}
+}
+
+// openSpillFile opens or creates a spill file and counts the messages in it
+func openSpillFile(path string) (*spillFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	input, err := os.Open(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f := &spillFile{path: path, file: file, input: input}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		f.count++
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		input.Close()
+		return nil, err
+	}
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		input.Close()
+		return nil, err
+	}
+	f.reader = bufio.NewReader(input)
+	f.used = f.count > 0
+	return f, nil
+}
+
+// append writes a message to the end of the file
+func (f *spillFile) append(m inboundMessage) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	f.count++
+	f.used = true
+	return nil
+}
+
+// read reads the next n lines and returns their messages and the number of lines
+// read, which the caller takes off the count. Lines that can't be parsed, like one
+// cut off by a crash, are skipped.
+func (f *spillFile) read(n int) ([]inboundMessage, int, error) {
+	var messages []inboundMessage
+	lines := 0
+	for lines < n {
+		line, err := f.reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// The count is off, e.g. after a partial line
+			return messages, n, nil
+		}
+		if err != nil {
+			return messages, lines, err
+		}
+		lines++
+
+		var m inboundMessage
+		if err := json.Unmarshal(line, &m); err != nil {
+			log.Printf("Skipping invalid line in spill file %s: %v", f.path, err)
+			continue
+		}
+		messages = append(messages, m)
+	}
+	return messages, lines, nil
+}
+
+// reset truncates the file once all its messages are handled, the caller holds
+// the shard mutex
+func (f *spillFile) reset() error {
+	if err := f.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.input.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.reader.Reset(f.input)
+	f.used = false
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// spillPipeline returns a pipeline with one worker that spills everything after
+// the first two messages, and the channel its handled messages go to
+func spillPipeline(t *testing.T, dir string) (*pipeline, chan string) {
+	t.Helper()
+	handled := make(chan string, 100)
+	p, err := newPipeline(&PipelineConfig{Workers: 1, QueueSize: 2, Overflow: overflowSpill, SpillDir: dir},
+		func(m inboundMessage) { handled <- string(m.Payload) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, s := range p.shards {
+			s.spill.file.Close()
+			s.spill.input.Close()
+		}
+	})
+	return p, handled
+}
+
+func pushMessages(p *pipeline, from, to int) {
+	for i := from; i < to; i++ {
+		p.push(inboundMessage{Topic: "plc/1", Payload: []byte(fmt.Sprint(i))})
+	}
+}
+
+func expectHandled(t *testing.T, handled chan string, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		select {
+		case got := <-handled:
+			if want := fmt.Sprint(i); got != want {
+				t.Fatalf("got message %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d was not handled", i)
+		}
+	}
+}
+
+func TestPipelineSpillOrder(t *testing.T) {
+	p, handled := spillPipeline(t, t.TempDir())
+
+	// Two messages fit in the queue, the others go to the spill file, also the
+	// ones pushed while the worker reads them back
+	pushMessages(p, 0, 10)
+	if stats := p.stats(); stats.QueueDepth != 2 || stats.Spilled != 8 {
+		t.Fatalf("got %d queued and %d spilled, want 2 and 8", stats.QueueDepth, stats.Spilled)
+	}
+	p.start()
+	pushMessages(p, 10, 20)
+	expectHandled(t, handled, 0, 20)
+
+	// The file is emptied once everything is handled, then the queue is used again
+	pushMessages(p, 20, 21)
+	expectHandled(t, handled, 20, 21)
+	s := p.shards[0]
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.spill.count != 0 || s.spill.used {
+		t.Errorf("got %d unread messages in the spill file, used %v, want an empty file", s.spill.count, s.spill.used)
+	}
+}
+
+func TestPipelineSpillResume(t *testing.T) {
+	dir := t.TempDir()
+	p, _ := spillPipeline(t, dir)
+	pushMessages(p, 0, 10)
+
+	// After a restart the spilled messages are processed before new ones, the
+	// two in memory are lost
+	p, handled := spillPipeline(t, dir)
+	if stats := p.stats(); stats.Spilled != 8 {
+		t.Fatalf("got %d spilled messages after the restart, want 8", stats.Spilled)
+	}
+	p.start()
+	pushMessages(p, 10, 12)
+	expectHandled(t, handled, 2, 12)
+}
+
+func TestPipelineSpillKeptUntilHandled(t *testing.T) {
+	dir := t.TempDir()
+	handling := make(chan string)
+	release := make(chan struct{})
+	p, err := newPipeline(&PipelineConfig{Workers: 1, QueueSize: 2, Overflow: overflowSpill, SpillDir: dir},
+		func(m inboundMessage) {
+			handling <- string(m.Payload)
+			<-release
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(release)
+	pushMessages(p, 0, 4)
+	p.start()
+
+	// While message 2 is handled both spilled messages are read back, but a
+	// crash now must not lose them
+	for i := 0; i < 3; i++ {
+		if got := <-handling; got != fmt.Sprint(i) {
+			t.Fatalf("got message %s, want %d", got, i)
+		}
+		if i < 2 {
+			release <- struct{}{}
+		}
+	}
+	f, err := openSpillFile(spillFilePath(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.file.Close()
+	defer f.input.Close()
+	if f.count != 2 {
+		t.Errorf("got %d messages in the spill file while they are handled, want 2", f.count)
+	}
+}
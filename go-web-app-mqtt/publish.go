@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-mqtt-broker/mqttclient"
+)
+
+// Time to wait for the broker to acknowledge a message published from the web interface
+const publishTimeout = 5 * time.Second
+
+// PublishRequest is the JSON body of /api/publish. The properties after Retain
+// need mqtt_protocol_version 5.
+type PublishRequest struct {
+	Topic                string                    `json:"topic"`
+	Payload              string                    `json:"payload"`
+	QoS                  byte                      `json:"qos"`
+	Retain               bool                      `json:"retain"`
+	UserProperties       []mqttclient.UserProperty `json:"user_properties,omitempty"`
+	ContentType          string                    `json:"content_type,omitempty"`
+	ResponseTopic        string                    `json:"response_topic,omitempty"`
+	CorrelationData      string                    `json:"correlation_data,omitempty"`
+	MessageExpirySeconds int                       `json:"message_expiry_seconds,omitempty"` // The broker drops the message when it couldn't be delivered in time
+}
+
+// publishOptions returns the MQTT 5 properties of the request as publish options
+func (r PublishRequest) publishOptions() []mqttclient.PublishOption {
+	var options []mqttclient.PublishOption
+	for _, property := range r.UserProperties {
+		options = append(options, mqttclient.WithUserProperty(property.Key, property.Value))
+	}
+	if r.ContentType != "" {
+		options = append(options, mqttclient.WithContentType(r.ContentType))
+	}
+	if r.ResponseTopic != "" {
+		options = append(options, mqttclient.WithResponseTopic(r.ResponseTopic))
+	}
+	if r.CorrelationData != "" {
+		options = append(options, mqttclient.WithCorrelationData([]byte(r.CorrelationData)))
+	}
+	if r.MessageExpirySeconds != 0 {
+		options = append(options, mqttclient.WithMessageExpiry(time.Duration(r.MessageExpirySeconds)*time.Second))
+	}
+	return options
+}
+
+// servePublish publishes a message with the MQTT client of the app and waits
+// until the broker acknowledged it (for QoS 0, until it was sent)
+func servePublish(c *gin.Context) {
+	var request PublishRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := mqttclient.ValidateTopic(request.Topic); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.QoS > 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "qos must be 0, 1 or 2"})
+		return
+	}
+	if request.MessageExpirySeconds < 0 || request.MessageExpirySeconds > math.MaxUint32 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("message_expiry_seconds must be between 0 (no expiry) and %d", uint32(math.MaxUint32))})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), publishTimeout)
+	defer cancel()
+	err := currentMQTTClient().Publish(ctx, request.Topic, request.QoS, request.Retain, []byte(request.Payload), request.publishOptions()...)
+	if errors.Is(err, mqttclient.ErrRequiresMQTT5) || errors.Is(err, mqttclient.ErrInvalidTopic) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": fmt.Sprintf("Broker did not acknowledge the message within %s", publishTimeout)})
+		return
+	}
+	if err != nil {
+		log.Printf("Error publishing to topic %s: %v", request.Topic, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Publish failed: %v", err)})
+		return
+	}
+
+	log.Printf("Published message from web interface to topic %s", request.Topic)
+	c.JSON(http.StatusOK, gin.H{"status": "published", "topic": request.Topic})
+}
+
+// Time /api/request waits for a response by default, and at most
+const (
+	defaultRequestTimeout = 10 * time.Second
+	maxRequestTimeout     = 60 * time.Second
+)
+
+// RPCRequest is the JSON body of /api/request
+type RPCRequest struct {
+	Topic          string `json:"topic"`
+	Payload        string `json:"payload"`
+	QoS            byte   `json:"qos"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+}
+
+// RPCResponse is the response of a device to /api/request
+type RPCResponse struct {
+	Topic          string                    `json:"topic"`
+	Payload        string                    `json:"payload"`
+	Encoding       string                    `json:"encoding"` // utf8 or base64, how the payload is encoded
+	UserProperties []mqttclient.UserProperty `json:"user_properties,omitempty"`
+	ContentType    string                    `json:"content_type,omitempty"`
+}
+
+// serveRequest publishes a request with the MQTT client of the app and waits
+// for the response, see mqttclient.Client.Request for the conventions
+func serveRequest(c *gin.Context) {
+	var request RPCRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := mqttclient.ValidateTopic(request.Topic); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.QoS > 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "qos must be 0, 1 or 2"})
+		return
+	}
+	timeout := defaultRequestTimeout
+	if request.TimeoutSeconds != 0 {
+		timeout = time.Duration(request.TimeoutSeconds) * time.Second
+	}
+	if timeout <= 0 || timeout > maxRequestTimeout {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("timeout_seconds must be between 1 and %d", int(maxRequestTimeout/time.Second))})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	response, err := currentMQTTClient().Request(ctx, request.Topic, request.QoS, []byte(request.Payload))
+	if errors.Is(err, mqttclient.ErrInvalidTopic) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": fmt.Sprintf("No response within %s", timeout)})
+		return
+	}
+	if err != nil {
+		log.Printf("Error sending request to topic %s: %v", request.Topic, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Request failed: %v", err)})
+		return
+	}
+
+	log.Printf("Request from web interface to topic %s answered on %s", request.Topic, response.Topic)
+	result := RPCResponse{
+		Topic:          response.Topic,
+		UserProperties: response.UserProperties,
+		ContentType:    response.ContentType,
+	}
+	result.Payload, result.Encoding = encodePayload(response.Payload)
+	c.JSON(http.StatusOK, result)
+}
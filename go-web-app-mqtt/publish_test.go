@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPublishValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name    string
+		handler gin.HandlerFunc
+		body    string
+	}{
+		{"publish without topic", servePublish, `{"payload": "1"}`},
+		{"publish to a wildcard", servePublish, `{"topic": "plc/#"}`},
+		{"publish with qos 3", servePublish, `{"topic": "plc/1", "qos": 3}`},
+		{"publish with negative expiry", servePublish, `{"topic": "plc/1", "message_expiry_seconds": -1}`},
+		{"publish with too long expiry", servePublish, `{"topic": "plc/1", "message_expiry_seconds": 4294967296}`},
+		{"request to a wildcard", serveRequest, `{"topic": "plc/+"}`},
+		{"request with negative timeout", serveRequest, `{"topic": "plc/1", "timeout_seconds": -5}`},
+		{"request with too long timeout", serveRequest, `{"topic": "plc/1", "timeout_seconds": 61}`},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/publish", strings.NewReader(test.body))
+		test.handler(c)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-mqtt-broker/mqttclient"
+)
+
+// Defaults for the retention job when config.json doesn't set them
+const (
+	defaultCompactionInterval = time.Hour
+	defaultVacuumInterval     = 24 * time.Hour
+	compactionChunkSize       = 5000 // Raw rows compacted per transaction
+)
+
+// RetentionConfig holds the retention rules and the schedule of the background job
+type RetentionConfig struct {
+	CompactionInterval string          `json:"compaction_interval,omitempty"` // How often the rules are applied, e.g. "1h"
+	VacuumInterval     string          `json:"vacuum_interval,omitempty"`     // How often the database file is vacuumed, "0" disables it
+	Rules              []RetentionRule `json:"rules,omitempty"`
+}
+
+// RetentionRule limits how long the messages of matching topics are stored.
+// Rules are checked in order and the first rule matching a topic applies to it,
+// topics that match no rule are kept forever.
+type RetentionRule struct {
+	Topic           string `json:"topic"`                      // MQTT topic filter
+	KeepRaw         string `json:"keep_raw"`                   // Age after which raw messages are removed, e.g. "7d"
+	Downsample      string `json:"downsample,omitempty"`       // Bucket size for min/max/avg of removed numeric messages and decoded fields, e.g. "1h"
+	KeepDownsampled string `json:"keep_downsampled,omitempty"` // Age after which buckets are removed, empty keeps them forever
+}
+
+// retentionRule is a RetentionRule with parsed durations
+type retentionRule struct {
+	topic           string
+	keepRaw         time.Duration
+	downsample      time.Duration
+	keepDownsampled time.Duration
+}
+
+// parseRetentionDuration parses a Go duration and additionally accepts whole days, e.g. "7d"
+func parseRetentionDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// parseRetentionRules validates the rules and parses their durations
+func parseRetentionRules(rules []RetentionRule) ([]retentionRule, error) {
+	var parsed []retentionRule
+	for _, rule := range rules {
+		if err := mqttclient.ValidateFilter(rule.Topic); err != nil {
+			return nil, err
+		}
+		r := retentionRule{topic: rule.Topic}
+
+		var err error
+		if r.keepRaw, err = parseRetentionDuration(rule.KeepRaw); err != nil || r.keepRaw <= 0 {
+			return nil, fmt.Errorf("rule %s: keep_raw must be a positive duration", rule.Topic)
+		}
+		if rule.Downsample != "" {
+			if r.downsample, err = parseRetentionDuration(rule.Downsample); err != nil || r.downsample <= 0 {
+				return nil, fmt.Errorf("rule %s: downsample must be a positive duration", rule.Topic)
+			}
+		}
+		if rule.KeepDownsampled != "" {
+			if r.keepDownsampled, err = parseRetentionDuration(rule.KeepDownsampled); err != nil || r.keepDownsampled <= 0 {
+				return nil, fmt.Errorf("rule %s: keep_downsampled must be a positive duration", rule.Topic)
+			}
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// parseRetentionConfig validates the retention config and returns the parsed
+// rules and intervals, a vacuum interval of 0 disables vacuuming. Without a
+// retention section there are no rules.
+func parseRetentionConfig(config *RetentionConfig) (rules []retentionRule, compactionInterval, vacuumInterval time.Duration, err error) {
+	if config == nil {
+		config = &RetentionConfig{}
+	}
+	if rules, err = parseRetentionRules(config.Rules); err != nil {
+		return nil, 0, 0, err
+	}
+
+	compactionInterval = defaultCompactionInterval
+	if config.CompactionInterval != "" {
+		if compactionInterval, err = parseRetentionDuration(config.CompactionInterval); err != nil || compactionInterval <= 0 {
+			return nil, 0, 0, fmt.Errorf("invalid compaction_interval %q", config.CompactionInterval)
+		}
+	}
+	vacuumInterval = defaultVacuumInterval
+	if config.VacuumInterval != "" {
+		if vacuumInterval, err = parseRetentionDuration(config.VacuumInterval); err != nil || vacuumInterval < 0 {
+			return nil, 0, 0, fmt.Errorf("invalid vacuum_interval %q", config.VacuumInterval)
+		}
+	}
+	return rules, compactionInterval, vacuumInterval, nil
+}
+
+// runRetention applies the retention rules on a schedule. It never returns.
+func runRetention(config *RetentionConfig) {
+	rules, compactionInterval, vacuumInterval, err := parseRetentionConfig(config)
+	if err != nil {
+		log.Fatalf("Error in retention config: %v", err)
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	compactionTicker := time.NewTicker(compactionInterval)
+	defer compactionTicker.Stop()
+
+	// A nil channel never fires, which disables vacuuming
+	var vacuumC <-chan time.Time
+	if vacuumInterval > 0 {
+		vacuumTicker := time.NewTicker(vacuumInterval)
+		defer vacuumTicker.Stop()
+		vacuumC = vacuumTicker.C
+	}
+
+	applyRetentionRules(rules, time.Now())
+	for {
+		select {
+		case now := <-compactionTicker.C:
+			applyRetentionRules(rules, now)
+		case <-vacuumC:
+			vacuumDatabase()
+		}
+	}
+}
+
+// applyRetentionRules removes expired messages and buckets for every rule
+func applyRetentionRules(rules []retentionRule, now time.Time) {
+	for i, rule := range rules {
+		// A topic belongs to the first rule it matches
+		condition, args := ruleCondition(rules[:i+1])
+
+		compacted, err := compactRawMessages(rule, condition, args, now.Add(-rule.keepRaw))
+		if err != nil {
+			log.Printf("Error applying retention rule %s: %v", rule.topic, err)
+			continue
+		}
+
+		var expired int64
+		if rule.keepDownsampled > 0 {
+			cutoff := now.Add(-rule.keepDownsampled).UTC().Format(dbTimeLayout)
+			result, err := db.Exec(`DELETE FROM mqtt_data_downsampled WHERE bucket_start < ? AND `+condition+`;`,
+				append([]any{cutoff}, args...)...)
+			if err != nil {
+				log.Printf("Error removing downsampled data for rule %s: %v", rule.topic, err)
+				continue
+			}
+			expired, _ = result.RowsAffected()
+		}
+
+		if compacted > 0 || expired > 0 {
+			log.Printf("Retention rule %s: removed %d raw messages and %d downsampled buckets", rule.topic, compacted, expired)
+		}
+	}
+}
+
+// ruleCondition returns an SQL condition on the topic column matching the last rule
+// but none of the rules before it, together with its arguments
+func ruleCondition(rules []retentionRule) (string, []any) {
+	last := len(rules) - 1
+	conditions := []string{"mqtt_match(?, topic)"}
+	args := []any{rules[last].topic}
+	for _, rule := range rules[:last] {
+		conditions = append(conditions, "NOT mqtt_match(?, topic)")
+		args = append(args, rule.topic)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// bucketKey identifies a downsampled bucket, field is empty for the payloads
+type bucketKey struct {
+	topic string
+	field string
+	start time.Time
+}
+
+// bucket accumulates the messages of one topic, field and time bucket
+type bucket struct {
+	count       int64 // All messages, for fields the messages with the field
+	valueCount  int64 // Numeric payloads or field values
+	min, max    float64
+	sum         float64
+	unit        *string // Unit of the field
+	lastMessage int64   // Last message counted, fields of "*" paths have several values per message
+}
+
+// add updates min, max and sum with a numeric value
+func (b *bucket) add(value float64) {
+	if b.valueCount == 0 || value < b.min {
+		b.min = value
+	}
+	if b.valueCount == 0 || value > b.max {
+		b.max = value
+	}
+	b.sum += value
+	b.valueCount++
+}
+
+// compactRawMessages removes the raw messages received before the cutoff, in chunks.
+// When the rule downsamples, the numeric payloads and the numeric decoded fields of
+// each chunk are folded into buckets in the same transaction as the delete. It
+// returns the number of removed messages.
+func compactRawMessages(rule retentionRule, condition string, args []any, cutoff time.Time) (int64, error) {
+	var total int64
+	cutoffText := cutoff.UTC().Format(dbTimeLayout)
+	for {
+		tx, err := db.Begin()
+		if err != nil {
+			return total, err
+		}
+
+		rows, err := tx.Query(`
+		SELECT id, topic, COALESCE(message, ''), received_at FROM mqtt_data_received
+		WHERE received_at < ? AND `+condition+`
+		ORDER BY id ASC
+		LIMIT ?;
+		`, append(append([]any{cutoffText}, args...), compactionChunkSize)...)
+		if err != nil {
+			tx.Rollback()
+			return total, err
+		}
+
+		buckets := make(map[bucketKey]*bucket)
+		var lastID, count int64
+		for rows.Next() {
+			var m Message
+			if err := rows.Scan(&m.ID, &m.Topic, &m.Message, &m.ReceivedAt); err != nil {
+				rows.Close()
+				tx.Rollback()
+				return total, err
+			}
+			lastID = m.ID
+			count++
+
+			if rule.downsample > 0 {
+				addToBucket(buckets, m, rule.downsample)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			tx.Rollback()
+			return total, err
+		}
+		if count == 0 {
+			tx.Rollback()
+			return total, nil
+		}
+
+		// The messages of this chunk, for the decoded values and the deletes
+		chunkCondition := `id <= ? AND received_at < ? AND ` + condition
+		chunkArgs := append([]any{lastID, cutoffText}, args...)
+
+		if rule.downsample > 0 {
+			if err := addFieldsToBuckets(tx, buckets, chunkCondition, chunkArgs, rule.downsample); err != nil {
+				tx.Rollback()
+				return total, err
+			}
+		}
+
+		for key, b := range buckets {
+			// Buckets without numeric payloads have no min and max
+			var minValue, maxValue any
+			if b.valueCount > 0 {
+				minValue, maxValue = b.min, b.max
+			}
+			_, err := tx.Exec(`
+			INSERT INTO mqtt_data_downsampled (topic, field, bucket_start, bucket_seconds, message_count, value_count, min_value, max_value, value_sum, unit)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (topic, field, bucket_seconds, bucket_start) DO UPDATE SET
+				message_count = message_count + excluded.message_count,
+				value_count = value_count + excluded.value_count,
+				min_value = CASE WHEN excluded.value_count = 0 THEN min_value WHEN value_count = 0 THEN excluded.min_value ELSE MIN(min_value, excluded.min_value) END,
+				max_value = CASE WHEN excluded.value_count = 0 THEN max_value WHEN value_count = 0 THEN excluded.max_value ELSE MAX(max_value, excluded.max_value) END,
+				value_sum = value_sum + excluded.value_sum,
+				unit = COALESCE(excluded.unit, unit);
+			`, key.topic, key.field, key.start.Format(dbTimeLayout), int64(rule.downsample/time.Second), b.count, b.valueCount, minValue, maxValue, b.sum, b.unit)
+			if err != nil {
+				tx.Rollback()
+				return total, err
+			}
+		}
+
+		// Remove the decoded values of the messages first
+		_, err = tx.Exec(`
+		DELETE FROM mqtt_data_values WHERE message_id IN (
+			SELECT id FROM mqtt_data_received WHERE `+chunkCondition+`
+		);
+		`, chunkArgs...)
+		if err != nil {
+			tx.Rollback()
+			return total, err
+		}
+
+		_, err = tx.Exec(`DELETE FROM mqtt_data_received WHERE `+chunkCondition+`;`, chunkArgs...)
+		if err != nil {
+			tx.Rollback()
+			return total, err
+		}
+		if err := tx.Commit(); err != nil {
+			return total, err
+		}
+		total += count
+
+		if count < compactionChunkSize {
+			return total, nil
+		}
+	}
+}
+
+// getBucket returns the bucket of the key, it is created when it doesn't exist yet
+func getBucket(buckets map[bucketKey]*bucket, key bucketKey) *bucket {
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{}
+		buckets[key] = b
+	}
+	return b
+}
+
+// addToBucket counts the message in its bucket, numeric payloads also update min, max and sum
+func addToBucket(buckets map[bucketKey]*bucket, m Message, size time.Duration) {
+	b := getBucket(buckets, bucketKey{topic: m.Topic, start: m.ReceivedAt.UTC().Truncate(size)})
+	b.count++
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(m.Message), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	b.add(value)
+}
+
+// addFieldsToBuckets folds the numeric decoded values of the messages matching the
+// condition into buckets per topic and field, like the payloads in addToBucket
+func addFieldsToBuckets(tx *sql.Tx, buckets map[bucketKey]*bucket, condition string, args []any, size time.Duration) error {
+	rows, err := tx.Query(`
+	SELECT message_id, topic, field, value_num, unit, received_at FROM mqtt_data_values
+	WHERE value_type IN ('float', 'int') AND message_id IN (
+		SELECT id FROM mqtt_data_received WHERE `+condition+`
+	)
+	ORDER BY message_id;
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID  int64
+			key        bucketKey
+			value      float64
+			unit       *string
+			receivedAt time.Time
+		)
+		if err := rows.Scan(&messageID, &key.topic, &key.field, &value, &unit, &receivedAt); err != nil {
+			return err
+		}
+		key.start = receivedAt.UTC().Truncate(size)
+
+		b := getBucket(buckets, key)
+		if b.lastMessage != messageID {
+			b.count++
+			b.lastMessage = messageID
+		}
+		if unit != nil {
+			b.unit = unit
+		}
+		b.add(value)
+	}
+	return rows.Err()
+}
+
+// vacuumDatabase rebuilds the database file to return the space of removed rows to
+// the file system. It runs on the writer goroutine so no batch waits on the lock.
+func vacuumDatabase() {
+	start := time.Now()
+	err := writer.exclusive(func() error {
+		if _, err := db.Exec(`VACUUM;`); err != nil {
+			return err
+		}
+		_, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE);`)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error vacuuming database: %v", err)
+		return
+	}
+	log.Printf("Database vacuumed in %s", time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// openTestDatabase creates the database in a temporary directory, it is closed
+// when the test ends
+func openTestDatabase(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	initDatabase()
+	t.Cleanup(func() {
+		db.Close()
+		os.Chdir(wd)
+	})
+}
+
+func TestCompactionDownsamplesFields(t *testing.T) {
+	openTestDatabase(t)
+	now := time.Date(2024, 9, 6, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-2 * time.Hour).Add(10 * time.Minute)
+
+	// Two messages with decoded fields, one with a numeric payload
+	messages := []struct {
+		topic, message string
+		values         [][]any // field, item, type, number, text, unit
+	}{
+		{`encoder/data`, `[{"voltage": 1.5, "angle": 90}, {"voltage": 2.5}]`, [][]any{
+			{"voltage", 0, "float", 1.5, nil, "V"},
+			{"voltage", 1, "float", 2.5, nil, "V"},
+			{"angle", 0, "int", 90, nil, "deg"},
+			{"name", nil, "string", nil, "line1", nil},
+		}},
+		{`encoder/data`, `[{"voltage": 3.5}]`, [][]any{
+			{"voltage", 0, "float", 3.5, nil, "V"},
+		}},
+		{`encoder/temp`, `21.5`, nil},
+	}
+	for _, m := range messages {
+		result, err := db.Exec(`INSERT INTO mqtt_data_received (topic, message, received_at) VALUES (?, ?, ?);`,
+			m.topic, m.message, old.Format(dbTimeLayout))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := result.LastInsertId()
+		for _, v := range m.values {
+			_, err := db.Exec(`
+			INSERT INTO mqtt_data_values (message_id, topic, field, item, value_type, value_num, value_text, unit, received_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+			`, append(append([]any{id, m.topic}, v...), old.Format(dbTimeLayout))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	rules, err := parseRetentionRules([]RetentionRule{{Topic: "encoder/#", KeepRaw: "1h", Downsample: "1h"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyRetentionRules(rules, now)
+
+	var remaining int
+	if err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM mqtt_data_received) + (SELECT COUNT(*) FROM mqtt_data_values);`).Scan(&remaining); err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 0 {
+		t.Errorf("%d raw rows left after compaction", remaining)
+	}
+
+	type row struct {
+		messages, values int64
+		min, max, sum    *float64
+		unit             *string
+	}
+	rows, err := db.Query(`
+	SELECT topic, field, message_count, value_count, min_value, max_value, value_sum, unit FROM mqtt_data_downsampled
+	WHERE bucket_start = ? AND bucket_seconds = 3600;
+	`, now.Add(-2*time.Hour).Format(dbTimeLayout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := make(map[string]row)
+	for rows.Next() {
+		var topic, field string
+		var r row
+		if err := rows.Scan(&topic, &field, &r.messages, &r.values, &r.min, &r.max, &r.sum, &r.unit); err != nil {
+			t.Fatal(err)
+		}
+		got[topic+":"+field] = r
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(key string, messages, values int64, min, max, sum float64, unit string) {
+		t.Helper()
+		r, ok := got[key]
+		if !ok {
+			t.Errorf("no bucket for %s", key)
+			return
+		}
+		if r.messages != messages || r.values != values {
+			t.Errorf("%s: got %d messages and %d values, want %d and %d", key, r.messages, r.values, messages, values)
+		}
+		if values > 0 && (r.min == nil || *r.min != min || *r.max != max || *r.sum != sum) {
+			t.Errorf("%s: got min %v, max %v, sum %v, want %v, %v, %v", key, r.min, r.max, r.sum, min, max, sum)
+		}
+		if unit != "" && (r.unit == nil || *r.unit != unit) {
+			t.Errorf("%s: got unit %v, want %s", key, r.unit, unit)
+		}
+	}
+	check("encoder/data:", 2, 0, 0, 0, 0, "")
+	check("encoder/data:voltage", 2, 3, 1.5, 3.5, 7.5, "V")
+	check("encoder/data:angle", 1, 1, 90, 90, 90, "deg")
+	check("encoder/temp:", 1, 1, 21.5, 21.5, 21.5, "")
+	if len(got) != 4 {
+		t.Errorf("got buckets %v, want 4 (string fields have none)", got)
+	}
+
+	// Charts of the field include the buckets of the removed values
+	series, err := querySeries("encoder/#", "voltage", now.Add(-3*time.Hour), now, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 || len(series[0].Points) != 1 {
+		t.Fatalf("got series %+v, want one point", series)
+	}
+	if p := series[0].Points[0]; p.Count != 3 || p.Avg != 2.5 || series[0].Unit != "V" {
+		t.Errorf("got point %+v with unit %q, want 3 values with average 2.5 V", p, series[0].Unit)
+	}
+}
+
+func TestParseRetentionConfig(t *testing.T) {
+	tests := []struct {
+		name               string
+		config             *RetentionConfig
+		wantRules          []retentionRule
+		compaction, vacuum time.Duration
+		wantErr            bool
+	}{
+		{name: "no section", compaction: defaultCompactionInterval, vacuum: defaultVacuumInterval},
+		{
+			name: "rules with days",
+			config: &RetentionConfig{CompactionInterval: "15m", VacuumInterval: "7d", Rules: []RetentionRule{
+				{Topic: "plc/+/temp", KeepRaw: "7d", Downsample: "1h", KeepDownsampled: "365d"},
+				{Topic: "#", KeepRaw: "36h"},
+			}},
+			wantRules: []retentionRule{
+				{topic: "plc/+/temp", keepRaw: 7 * 24 * time.Hour, downsample: time.Hour, keepDownsampled: 365 * 24 * time.Hour},
+				{topic: "#", keepRaw: 36 * time.Hour},
+			},
+			compaction: 15 * time.Minute,
+			vacuum:     7 * 24 * time.Hour,
+		},
+		{name: "vacuum disabled", config: &RetentionConfig{VacuumInterval: "0"}, compaction: defaultCompactionInterval},
+		{name: "invalid topic", config: &RetentionConfig{Rules: []RetentionRule{{Topic: "plc/#/temp", KeepRaw: "1d"}}}, wantErr: true},
+		{name: "missing keep_raw", config: &RetentionConfig{Rules: []RetentionRule{{Topic: "plc/#"}}}, wantErr: true},
+		{name: "negative keep_raw", config: &RetentionConfig{Rules: []RetentionRule{{Topic: "plc/#", KeepRaw: "-1d"}}}, wantErr: true},
+		{name: "fractional days", config: &RetentionConfig{Rules: []RetentionRule{{Topic: "plc/#", KeepRaw: "1.5d"}}}, wantErr: true},
+		{name: "zero downsample", config: &RetentionConfig{Rules: []RetentionRule{{Topic: "plc/#", KeepRaw: "1d", Downsample: "0"}}}, wantErr: true},
+		{name: "invalid keep_downsampled", config: &RetentionConfig{Rules: []RetentionRule{{Topic: "plc/#", KeepRaw: "1d", KeepDownsampled: "forever"}}}, wantErr: true},
+		{name: "zero compaction interval", config: &RetentionConfig{CompactionInterval: "0s"}, wantErr: true},
+		{name: "negative vacuum interval", config: &RetentionConfig{VacuumInterval: "-1h"}, wantErr: true},
+	}
+	for _, test := range tests {
+		rules, compaction, vacuum, err := parseRetentionConfig(test.config)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !slices.Equal(rules, test.wantRules) || compaction != test.compaction || vacuum != test.vacuum {
+			t.Errorf("%s: got rules %+v, compaction %s, vacuum %s, want %+v, %s, %s",
+				test.name, rules, compaction, vacuum, test.wantRules, test.compaction, test.vacuum)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Default number of messages kept in memory when config.json doesn't set it
+const defaultMessageBufferSize = 10000
+
+// messageRing keeps the newest messages in memory for /messages and /events.
+// It holds a fixed number of messages, ordered by ID, and overwrites the oldest
+// one when it is full.
+type messageRing struct {
+	mutex   sync.RWMutex
+	records []Message // Fixed length, the i-th oldest message is at (start+i) % len(records)
+	start   int
+	count   int
+}
+
+var messageBuffer *messageRing
+
+// newMessageRing creates a ring for capacity messages, zero falls back to the default
+func newMessageRing(capacity int) *messageRing {
+	if capacity <= 0 {
+		capacity = defaultMessageBufferSize
+	}
+	return &messageRing{records: make([]Message, capacity)}
+}
+
+// at returns the i-th oldest message, the caller holds the lock
+func (r *messageRing) at(i int) *Message {
+	return &r.records[(r.start+i)%len(r.records)]
+}
+
+// full reports whether the ring has dropped or may have skipped older messages,
+// the caller holds the lock
+func (r *messageRing) full() bool {
+	return r.count == len(r.records)
+}
+
+// add appends messages, which must have greater IDs than the ones in the ring
+func (r *messageRing) add(messages ...Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, m := range messages {
+		if r.full() {
+			r.records[r.start] = m
+			r.start = (r.start + 1) % len(r.records)
+		} else {
+			*r.at(r.count) = m
+			r.count++
+		}
+	}
+}
+
+// recent returns up to n of the newest messages matching the filters, oldest first.
+// complete is false when older messages that match may only be in the database.
+func (r *messageRing) recent(filters []string, n int) (data []Message, complete bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	data = []Message{}
+	for i := r.count - 1; i >= 0 && len(data) < n; i-- {
+		if m := r.at(i); matchesAny(filters, m.Topic) {
+			data = append(data, *m)
+		}
+	}
+	slices.Reverse(data)
+	return data, len(data) == n || !r.full()
+}
+
+// after returns up to n messages matching the filters with an ID greater than after.
+// complete is false when the cursor is older than the ring, then messages in
+// between may only be in the database.
+func (r *messageRing) after(after int64, filters []string, n int) (data []Message, complete bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if r.full() && after < r.at(0).ID-1 {
+		return nil, false
+	}
+
+	// Messages are ordered by ID, so find the first one newer than the cursor
+	start := sort.Search(r.count, func(i int) bool {
+		return r.at(i).ID > after
+	})
+	data = []Message{}
+	for i := start; i < r.count && len(data) < n; i++ {
+		if m := r.at(i); matchesAny(filters, m.Topic) {
+			data = append(data, *m)
+		}
+	}
+	return data, true
+}
+
+// recentMessages returns up to n of the newest messages matching the filters, oldest first.
+// The database is only queried when the ring doesn't hold enough of them.
+func recentMessages(filters []string, n int) []Message {
+	data, complete := messageBuffer.recent(filters, n)
+	if complete {
+		return data
+	}
+	stored, err := queryRecent(filters, n)
+	if err != nil {
+		log.Printf("Error querying recent messages: %v", err)
+		return data
+	}
+	return stored
+}
+
+// messagesAfter returns up to n messages matching the filters with an ID greater than
+// after. Cursors older than the ring are served from the database.
+func messagesAfter(after int64, filters []string, n int) []Message {
+	data, complete := messageBuffer.after(after, filters, n)
+	if complete {
+		return data
+	}
+	stored, err := queryHistory(historyQuery{topics: filters, after: after}, n)
+	if err != nil {
+		// The client keeps its cursor and tries again with the next poll
+		log.Printf("Error querying messages after %d: %v", after, err)
+		return []Message{}
+	}
+	return stored
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go-mqtt-broker/mqttclient"
+)
+
+// PayloadSchema describes the JSON payloads of the topics matching Topic.
+// Each field is decoded from the payload and stored as a typed value.
+type PayloadSchema struct {
+	Topic  string        `json:"topic"` // MQTT topic filter
+	Fields []SchemaField `json:"fields"`
+}
+
+// SchemaField maps a JSON path in the payload to a named value.
+//
+// The path is a list of object keys and array indexes separated by dots, e.g.
+// "data.voltage" or "readings.0.value". The segment "*" takes every element of
+// an array, so "*.voltage" decodes the voltage of every object in a payload that
+// is an array of objects. An empty path takes the whole payload.
+type SchemaField struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Type string `json:"type"`           // float, int, bool or string
+	Unit string `json:"unit,omitempty"` // Unit shown with the value, e.g. "V"
+}
+
+// Field is a decoded payload field. Value is set for paths without "*",
+// Values holds every matched element for paths with "*".
+type Field struct {
+	Type   string `json:"type"`
+	Unit   string `json:"unit,omitempty"`
+	Value  any    `json:"value,omitempty"`
+	Values []any  `json:"values,omitempty"`
+}
+
+// Supported field types
+const (
+	fieldTypeFloat  = "float"
+	fieldTypeInt    = "int"
+	fieldTypeBool   = "bool"
+	fieldTypeString = "string"
+)
+
+// validatePayloadSchemas checks the topic filters, field names and types
+func validatePayloadSchemas(schemas []PayloadSchema) error {
+	for _, schema := range schemas {
+		if err := mqttclient.ValidateFilter(schema.Topic); err != nil {
+			return err
+		}
+		names := make(map[string]bool)
+		for _, field := range schema.Fields {
+			if field.Name == "" {
+				return fmt.Errorf("schema %s: field without a name", schema.Topic)
+			}
+			if names[field.Name] {
+				return fmt.Errorf("schema %s: duplicate field %s", schema.Topic, field.Name)
+			}
+			names[field.Name] = true
+
+			switch field.Type {
+			case fieldTypeFloat, fieldTypeInt, fieldTypeBool, fieldTypeString:
+			default:
+				return fmt.Errorf("schema %s: field %s has unknown type %q", schema.Topic, field.Name, field.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// findPayloadSchema returns the first schema matching the topic, or nil
+func findPayloadSchema(schemas []PayloadSchema, topic string) *PayloadSchema {
+	for i := range schemas {
+		if mqttclient.Match(schemas[i].Topic, topic) {
+			return &schemas[i]
+		}
+	}
+	return nil
+}
+
+// decodePayload decodes the fields of the schema from a JSON payload.
+// Fields that are missing or don't convert to their type are left out.
+func decodePayload(schema *PayloadSchema, payload []byte) map[string]*Field {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber() // Keep integers exact
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return nil
+	}
+
+	fields := make(map[string]*Field)
+	for _, schemaField := range schema.Fields {
+		segments := splitPath(schemaField.Path)
+		field := &Field{Type: schemaField.Type, Unit: schemaField.Unit}
+
+		for _, raw := range lookupPath(document, segments) {
+			value, ok := convertValue(raw, schemaField.Type)
+			if !ok {
+				continue
+			}
+			field.Values = append(field.Values, value)
+		}
+
+		if len(field.Values) == 0 {
+			continue
+		}
+		if !isListPath(segments) {
+			field.Value, field.Values = field.Values[0], nil
+		}
+		fields[schemaField.Name] = field
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// splitPath splits a field path into its segments
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// isListPath reports whether the path can match more than one value
+func isListPath(segments []string) bool {
+	for _, segment := range segments {
+		if segment == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupPath returns the values at the path in the decoded JSON document
+func lookupPath(document any, segments []string) []any {
+	if len(segments) == 0 {
+		return []any{document}
+	}
+	segment, rest := segments[0], segments[1:]
+
+	switch node := document.(type) {
+	case map[string]any:
+		if child, ok := node[segment]; ok {
+			return lookupPath(child, rest)
+		}
+	case []any:
+		if segment == "*" {
+			var values []any
+			for _, child := range node {
+				values = append(values, lookupPath(child, rest)...)
+			}
+			return values
+		}
+		if index, err := strconv.Atoi(segment); err == nil && index >= 0 && index < len(node) {
+			return lookupPath(node[index], rest)
+		}
+	}
+	return nil
+}
+
+// convertValue converts a decoded JSON value to the field type.
+// Numbers may also be sent as strings, e.g. "21.5".
+func convertValue(raw any, fieldType string) (any, bool) {
+	switch fieldType {
+	case fieldTypeFloat:
+		switch v := raw.(type) {
+		case json.Number:
+			f, err := v.Float64()
+			return f, err == nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			return f, err == nil
+		}
+	case fieldTypeInt:
+		switch v := raw.(type) {
+		case json.Number:
+			i, err := v.Int64()
+			return i, err == nil
+		case string:
+			i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			return i, err == nil
+		}
+	case fieldTypeBool:
+		switch v := raw.(type) {
+		case bool:
+			return v, true
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			return b, err == nil
+		}
+	case fieldTypeString:
+		switch v := raw.(type) {
+		case string:
+			return v, true
+		case json.Number:
+			return v.String(), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+	}
+	return nil, false
+}
+
+// fieldColumns returns the value_num and value_text columns for a decoded value
+func fieldColumns(value any) (num any, text any) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return nil, v
+	}
+	return nil, nil
+}
+
+// fieldValue converts the stored columns back to a value of the field type.
+// value_num has NUMERIC affinity, so integers come back as int64 and other numbers as float64.
+func fieldValue(fieldType string, num any, text *string) any {
+	if fieldType == fieldTypeString {
+		if text == nil {
+			return nil
+		}
+		return *text
+	}
+
+	switch v := num.(type) {
+	case int64:
+		switch fieldType {
+		case fieldTypeBool:
+			return v != 0
+		case fieldTypeFloat:
+			return float64(v)
+		}
+		return v
+	case float64:
+		switch fieldType {
+		case fieldTypeBool:
+			return v != 0
+		case fieldTypeInt:
+			return int64(v)
+		}
+		return v
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-mqtt-broker/mqttclient"
+)
+
+const (
+	streamBufferSize    = 256              // Messages buffered per stream client before it is dropped
+	streamPingInterval  = 15 * time.Second // Interval of keep-alive comments on idle streams
+	streamRetryInterval = 2000             // Reconnect delay suggested to browsers, in milliseconds
+)
+
+// streamClient is a browser connected to the /events endpoint
+type streamClient struct {
+	filters  []string
+	messages chan Message
+}
+
+// streamHub fans out processed messages to all connected stream clients
+type streamHub struct {
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+}
+
+var hub = &streamHub{clients: make(map[*streamClient]struct{})}
+
+// subscribe registers a new client that receives messages matching the filters
+func (h *streamHub) subscribe(filters []string) *streamClient {
+	client := &streamClient{
+		filters:  filters,
+		messages: make(chan Message, streamBufferSize),
+	}
+	h.mu.Lock()
+	h.clients[client] = struct{}{}
+	h.mu.Unlock()
+	return client
+}
+
+// unsubscribe removes the client, it is safe to call more than once
+func (h *streamHub) unsubscribe(client *streamClient) {
+	h.mu.Lock()
+	if _, ok := h.clients[client]; ok {
+		delete(h.clients, client)
+		close(client.messages)
+	}
+	h.mu.Unlock()
+}
+
+// broadcast sends the message to every client whose filters match its topic.
+// A client that can't keep up is disconnected instead of blocking the others,
+// its browser reconnects and catches up from its last event ID.
+func (h *streamHub) broadcast(message Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.clients {
+		if !matchesAny(client.filters, message.Topic) {
+			continue
+		}
+		select {
+		case client.messages <- message:
+		default:
+			log.Printf("Stream client is too slow, disconnecting it")
+			delete(h.clients, client)
+			close(client.messages)
+		}
+	}
+}
+
+// serveEvents streams messages to the browser as Server-Sent Events.
+// Clients can limit the stream with one or more "topic" query parameters (MQTT filters)
+// and resume after a message ID with the Last-Event-ID header or the "after" parameter.
+func serveEvents(c *gin.Context) {
+	filters := c.QueryArray("topic")
+	for _, filter := range filters {
+		if err := mqttclient.ValidateFilter(filter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	after := int64(-1)
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("after")
+	}
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid last event ID"})
+			return
+		}
+		after = id
+	}
+
+	// Subscribe before reading the backlog so no message falls in between
+	client := hub.subscribe(filters)
+	defer hub.unsubscribe(client)
+
+	var backlog []Message
+	if after < 0 {
+		backlog = recentMessages(filters, recentMessageCount)
+	} else {
+		backlog = messagesAfter(after, filters, maxMessagesPerPoll)
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", streamRetryInterval)
+
+	lastSentID := after
+	for _, message := range backlog {
+		if err := writeEvent(c.Writer, message); err != nil {
+			return
+		}
+		lastSentID = message.ID
+	}
+	c.Writer.Flush()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case message, ok := <-client.messages:
+			if !ok {
+				// Dropped by the hub for being too slow
+				return
+			}
+			if message.ID <= lastSentID {
+				// Already sent as part of the backlog
+				continue
+			}
+			if err := writeEvent(c.Writer, message); err != nil {
+				return
+			}
+			lastSentID = message.ID
+			c.Writer.Flush()
+		case <-ping.C:
+			if _, err := io.WriteString(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// writeEvent writes a message as a Server-Sent Event with the message ID as event ID
+func writeEvent(w io.Writer, message Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", message.ID, data)
+	return err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-mqtt-broker/mqttclient"
+)
+
+// Time to wait for the broker to acknowledge a subscribe or unsubscribe
+const subscribeTimeout = 5 * time.Second
+
+// Subscription is a topic filter the app subscribes to with its QoS.
+// In config.json it is either an object or, for QoS 0, just the topic filter.
+type Subscription struct {
+	Topic string `json:"topic"`
+	QoS   byte   `json:"qos"`
+}
+
+// subscriptionsMutex serializes changes to the subscriptions
+var subscriptionsMutex sync.Mutex
+
+// UnmarshalJSON accepts a topic filter string or a {"topic", "qos"} object
+func (s *Subscription) UnmarshalJSON(data []byte) error {
+	var topic string
+	if err := json.Unmarshal(data, &topic); err == nil {
+		*s = Subscription{Topic: topic}
+		return nil
+	}
+
+	type plain Subscription // Without the UnmarshalJSON method
+	var sub plain
+	if err := json.Unmarshal(data, &sub); err != nil {
+		return err
+	}
+	*s = Subscription(sub)
+	return nil
+}
+
+// MarshalJSON writes QoS 0 subscriptions as plain topic filters, like older config files
+func (s Subscription) MarshalJSON() ([]byte, error) {
+	if s.QoS == 0 {
+		return json.Marshal(s.Topic)
+	}
+	type plain Subscription // Without the MarshalJSON method
+	return json.Marshal(plain(s))
+}
+
+// validateSubscription checks the topic filter and QoS
+func validateSubscription(sub Subscription) error {
+	if err := mqttclient.ValidateFilter(sub.Topic); err != nil {
+		return err
+	}
+	if sub.QoS > 2 {
+		return fmt.Errorf("qos must be 0, 1 or 2")
+	}
+	return nil
+}
+
+// Subscribe to the MQTT topic and pass incoming messages to the channel. The
+// wait for the broker ends after subscribeTimeout or when ctx is done.
+func subscribeToTopic(ctx context.Context, client *mqttclient.Client, sub Subscription) error {
+	ctx, cancel := context.WithTimeout(ctx, subscribeTimeout)
+	defer cancel()
+	err := client.Subscribe(ctx, sub.Topic, sub.QoS, func(msg mqttclient.Message) {
+		messagesReceived.WithLabelValues(msg.Topic).Inc()
+		lastMessageTime.SetToCurrentTime()
+
+		// Hand the message to the pipeline, which doesn't block unless the overflow policy is block
+		pipe.push(newInboundMessage(msg))
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("broker did not acknowledge the subscription within %s", subscribeTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Subscribed to topic: %s (QoS %d)\n", sub.Topic, sub.QoS)
+	return nil
+}
+
+// Unsubscribe from the MQTT topic, waiting at most subscribeTimeout or until ctx is done
+func unsubscribeFromTopic(ctx context.Context, client *mqttclient.Client, topic string) error {
+	ctx, cancel := context.WithTimeout(ctx, subscribeTimeout)
+	defer cancel()
+	err := client.Unsubscribe(ctx, topic)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("broker did not acknowledge the unsubscribe within %s", subscribeTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Unsubscribed from topic:", topic)
+	return nil
+}
+
+// serveSubscriptions lists the current subscriptions
+func serveSubscriptions(c *gin.Context) {
+	configMutex.RLock()
+	subscriptions := slices.Clone(currentConfig.MQTTTopics)
+	configMutex.RUnlock()
+
+	if subscriptions == nil {
+		subscriptions = []Subscription{}
+	}
+	c.JSON(http.StatusOK, subscriptions)
+}
+
+// addSubscription subscribes to a topic filter, or changes the QoS of an
+// existing subscription, and saves the subscriptions to config.json
+func addSubscription(c *gin.Context) {
+	var sub Subscription
+	if err := c.ShouldBindJSON(&sub); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := validateSubscription(sub); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+
+	if err := subscribeToTopic(c.Request.Context(), currentMQTTClient(), sub); err != nil {
+		log.Printf("Error subscribing to topic %s: %v", sub.Topic, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Subscribe failed: %v", err)})
+		return
+	}
+
+	configMutex.Lock()
+	subscriptions := slices.Clone(currentConfig.MQTTTopics)
+	index := slices.IndexFunc(subscriptions, func(s Subscription) bool { return s.Topic == sub.Topic })
+	if index >= 0 {
+		subscriptions[index] = sub
+	} else {
+		subscriptions = append(subscriptions, sub)
+	}
+	currentConfig.MQTTTopics = subscriptions
+	configMutex.Unlock()
+
+	if err := saveConfig(configFile); err != nil {
+		log.Printf("Error saving config: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Subscribed, but could not save config file"})
+		return
+	}
+	c.JSON(http.StatusOK, sub)
+}
+
+// removeSubscription unsubscribes from the topic filter in the "topic" query
+// parameter and saves the subscriptions to config.json
+func removeSubscription(c *gin.Context) {
+	topic := c.Query("topic")
+	if topic == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "topic parameter is required"})
+		return
+	}
+
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+
+	configMutex.RLock()
+	found := slices.ContainsFunc(currentConfig.MQTTTopics, func(s Subscription) bool { return s.Topic == topic })
+	configMutex.RUnlock()
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Not subscribed to %s", topic)})
+		return
+	}
+
+	if err := unsubscribeFromTopic(c.Request.Context(), currentMQTTClient(), topic); err != nil {
+		log.Printf("Error unsubscribing from topic %s: %v", topic, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Unsubscribe failed: %v", err)})
+		return
+	}
+
+	configMutex.Lock()
+	currentConfig.MQTTTopics = slices.DeleteFunc(slices.Clone(currentConfig.MQTTTopics), func(s Subscription) bool { return s.Topic == topic })
+	configMutex.Unlock()
+
+	if err := saveConfig(configFile); err != nil {
+		log.Printf("Error saving config: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unsubscribed, but could not save config file"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,17 @@
+package main
+
+import "go-mqtt-broker/mqttclient"
+
+// matchesAny reports whether the topic matches one of the filters.
+// An empty filter list matches every topic.
+func matchesAny(filters []string, topic string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, filter := range filters {
+		if mqttclient.Match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Messages whose fields are loaded per query, keeps the number of SQL variables low
+const fieldsChunkSize = 500
+
+// Value is a single decoded value as returned by /api/values
+type Value struct {
+	ID         int64     `json:"id"`
+	MessageID  int64     `json:"message_id"`
+	Topic      string    `json:"topic"`
+	Field      string    `json:"field"`
+	Item       *int64    `json:"item,omitempty"` // Index of the value for "*" paths
+	Type       string    `json:"type"`
+	Value      any       `json:"value"`
+	Unit       string    `json:"unit,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// valuesPage is the JSON response of /api/values
+type valuesPage struct {
+	Values    []Value `json:"values"`
+	NextAfter *int64  `json:"next_after"` // Cursor for the next page, null on the last page
+}
+
+// loadFields reads the decoded fields of the messages from the database
+func loadFields(messages []Message) error {
+	byID := make(map[int64]*Message, len(messages))
+	for i := range messages {
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	for start := 0; start < len(messages); start += fieldsChunkSize {
+		chunk := messages[start:min(start+fieldsChunkSize, len(messages))]
+		placeholders := make([]string, len(chunk))
+		args := make([]any, len(chunk))
+		for i, m := range chunk {
+			placeholders[i] = "?"
+			args[i] = m.ID
+		}
+
+		rows, err := db.Query(`
+		SELECT message_id, field, item, value_type, value_num, value_text, unit FROM mqtt_data_values
+		WHERE message_id IN (`+strings.Join(placeholders, ", ")+`)
+		ORDER BY message_id, field, item;
+		`, args...)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var (
+				messageID       int64
+				name, valueType string
+				item            *int64
+				num             any
+				text, unit      *string
+			)
+			if err := rows.Scan(&messageID, &name, &item, &valueType, &num, &text, &unit); err != nil {
+				rows.Close()
+				return err
+			}
+
+			m := byID[messageID]
+			if m.Fields == nil {
+				m.Fields = make(map[string]*Field)
+			}
+			field, ok := m.Fields[name]
+			if !ok {
+				field = &Field{Type: valueType}
+				if unit != nil {
+					field.Unit = *unit
+				}
+				m.Fields[name] = field
+			}
+
+			value := fieldValue(valueType, num, text)
+			if item == nil {
+				field.Value = value
+			} else {
+				field.Values = append(field.Values, value)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveValues returns decoded values filtered by topic, field and time range.
+//
+// Query parameters:
+//
+//	topic   MQTT topic filter, may be repeated (+ and # wildcards are supported)
+//	field   field name, may be repeated
+//	from    RFC 3339 time or date, inclusive
+//	to      RFC 3339 time or date, exclusive
+//	after   value ID to continue from, taken from next_after of the previous page
+//	limit   rows per page
+//
+// The q and format parameters of /api/history are not supported, values have no
+// payload to search and are only returned as JSON.
+func serveValues(c *gin.Context) {
+	query, err := parseHistoryQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if query.search != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The q parameter is not supported for values"})
+		return
+	}
+	if format := c.DefaultQuery("format", "json"); format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown format, values are only returned as json"})
+		return
+	}
+
+	conditions := []string{"id > ?"}
+	args := []any{query.after}
+	if len(query.topics) > 0 {
+		condition, topicArgs := topicCondition(query.topics)
+		conditions = append(conditions, condition)
+		args = append(args, topicArgs...)
+	}
+	if fields := c.QueryArray("field"); len(fields) > 0 {
+		conditions = append(conditions, fmt.Sprintf("field IN (%s)", strings.TrimSuffix(strings.Repeat("?, ", len(fields)), ", ")))
+		for _, field := range fields {
+			args = append(args, field)
+		}
+	}
+	if !query.from.IsZero() {
+		conditions = append(conditions, "received_at >= ?")
+		args = append(args, query.from.UTC().Format(dbTimeLayout))
+	}
+	if !query.to.IsZero() {
+		conditions = append(conditions, "received_at < ?")
+		args = append(args, query.to.UTC().Format(dbTimeLayout))
+	}
+	// Fetch one extra row to know if there is a next page
+	args = append(args, query.limit+1)
+
+	rows, err := db.Query(`
+	SELECT id, message_id, topic, field, item, value_type, value_num, value_text, unit, received_at FROM mqtt_data_values
+	WHERE `+strings.Join(conditions, " AND ")+`
+	ORDER BY id ASC
+	LIMIT ?;
+	`, args...)
+	if err != nil {
+		log.Printf("Error querying values: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not query values"})
+		return
+	}
+	defer rows.Close()
+
+	values := []Value{}
+	for rows.Next() {
+		var (
+			v          Value
+			num        any
+			text, unit *string
+		)
+		if err := rows.Scan(&v.ID, &v.MessageID, &v.Topic, &v.Field, &v.Item, &v.Type, &num, &text, &unit, &v.ReceivedAt); err != nil {
+			log.Printf("Error reading value row: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not query values"})
+			return
+		}
+		v.Value = fieldValue(v.Type, num, text)
+		if unit != nil {
+			v.Unit = *unit
+		}
+		values = append(values, v)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error reading value rows: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not query values"})
+		return
+	}
+
+	var nextAfter *int64
+	if len(values) > query.limit {
+		values = values[:query.limit]
+		nextAfter = &values[len(values)-1].ID
+	}
+	c.JSON(http.StatusOK, valuesPage{Values: values, NextAfter: nextAfter})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestValuesPaging(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	openTestDatabase(t)
+
+	// IDs 1 to 8, temp of plc/1 and plc/2 and the state of plc/1
+	values := []struct{ topic, field, receivedAt string }{
+		{"plc/1", "temp", "2024-09-06T12:00:00.000Z"},
+		{"plc/2", "temp", "2024-09-06T12:00:00.000Z"},
+		{"plc/1", "state", "2024-09-06T12:00:00.000Z"},
+		{"plc/1", "temp", "2024-09-06T12:01:00.000Z"},
+		{"plc/2", "temp", "2024-09-06T12:01:00.000Z"},
+		{"plc/1", "temp", "2024-09-06T12:02:00.000Z"},
+		{"plc/1", "state", "2024-09-06T12:02:00.000Z"},
+		{"plc/1", "temp", "2024-09-06T12:03:00.000Z"},
+	}
+	for i, v := range values {
+		if _, err := db.Exec(`
+		INSERT INTO mqtt_data_values (message_id, topic, field, value_type, value_num, received_at)
+		VALUES (?, ?, ?, 'number', ?, ?);
+		`, i+1, v.topic, v.field, i, v.receivedAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  [][]int64 // IDs of each page
+	}{
+		{"all", "limit=3", [][]int64{{1, 2, 3}, {4, 5, 6}, {7, 8}}},
+		{"exact pages", "limit=4", [][]int64{{1, 2, 3, 4}, {5, 6, 7, 8}}},
+		{"one page", "limit=100", [][]int64{{1, 2, 3, 4, 5, 6, 7, 8}}},
+		{"after a cursor", "after=5&limit=2", [][]int64{{6, 7}, {8}}},
+		{"after the last value", "after=8", [][]int64{{}}},
+		{"topic", "topic=plc/2&limit=1", [][]int64{{2}, {5}}},
+		{"wildcard and field", "topic=plc/%2B&field=temp&limit=2", [][]int64{{1, 2}, {4, 5}, {6, 8}}},
+		{"several fields", "field=temp&field=state&topic=plc/1&limit=5", [][]int64{{1, 3, 4, 6, 7}, {8}}},
+		{"time range", "from=2024-09-06T12:01:00Z&to=2024-09-06T12:03:00Z&limit=2", [][]int64{{4, 5}, {6, 7}}},
+	}
+	for _, test := range tests {
+		var pages [][]int64
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for len(pages) <= len(test.want) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/values?"+query.Encode(), nil)
+			serveValues(c)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("%s: got status %d: %s", test.name, recorder.Code, recorder.Body)
+			}
+
+			var page valuesPage
+			if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			ids := []int64{}
+			for _, v := range page.Values {
+				ids = append(ids, v.ID)
+			}
+			pages = append(pages, ids)
+			if page.NextAfter == nil {
+				break
+			}
+			query.Set("after", strconv.FormatInt(*page.NextAfter, 10))
+		}
+		if !slices.EqualFunc(pages, test.want, slices.Equal) {
+			t.Errorf("%s: got pages %v, want %v", test.name, pages, test.want)
+		}
+	}
+}
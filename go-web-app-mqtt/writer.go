@@ -0,0 +1,318 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"log"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Defaults for the database writer when config.json doesn't set them
+const (
+	defaultDBQueueSize       = 10000
+	defaultDBBatchSize       = 500
+	defaultDBFlushIntervalMS = 200
+)
+
+// A batch that fails, e.g. because the database stayed locked, is written again
+// after dbWriteRetryDelay, doubling with every attempt, and dropped after
+// dbWriteAttempts attempts
+const (
+	dbWriteAttempts   = 3
+	dbWriteRetryDelay = 100 * time.Millisecond
+)
+
+// dbWriter is the only goroutine writing messages to SQLite. It collects queued
+// messages into batches and inserts each batch in one transaction, which keeps
+// the messages in arrival order and avoids lock contention on the database.
+type dbWriter struct {
+	queue         chan Message
+	tasks         chan writerTask
+	batchSize     int
+	flushInterval time.Duration
+
+	insertMessage *sql.Stmt // Prepared when the writer starts
+	insertValue   *sql.Stmt
+	insert        func([]Message) error // insertBatch, replaced in tests
+
+	// Only used by the writer goroutine. Dropped messages get the IDs after the
+	// last one, so the frontend still shows them in order, and the next commit
+	// moves the ID sequence past them so the database never reuses their IDs.
+	lastID   int64
+	reserved int64 // Highest ID given to a dropped message, 0 when there is none
+
+	written atomic.Int64 // Messages committed to the database
+	failed  atomic.Int64 // Messages lost because their batch could not be committed
+	batches atomic.Int64 // Committed transactions
+}
+
+// writerTask is a function run on the writer goroutine
+type writerTask struct {
+	fn   func() error
+	done chan error
+}
+
+// writerStats is a snapshot of the writer metrics
+type writerStats struct {
+	QueueDepth    int   `json:"queue_depth"`
+	QueueCapacity int   `json:"queue_capacity"`
+	Written       int64 `json:"written"`
+	Failed        int64 `json:"failed"`
+	Batches       int64 `json:"batches"`
+}
+
+var writer *dbWriter
+
+// newDBWriter creates a writer, zero values fall back to the defaults
+func newDBWriter(queueSize, batchSize int, flushInterval time.Duration) *dbWriter {
+	if queueSize <= 0 {
+		queueSize = defaultDBQueueSize
+	}
+	if batchSize <= 0 {
+		batchSize = defaultDBBatchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultDBFlushIntervalMS * time.Millisecond
+	}
+	w := &dbWriter{
+		queue:         make(chan Message, queueSize),
+		tasks:         make(chan writerTask),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+	w.insert = w.insertBatch
+	return w
+}
+
+// enqueue queues a message for writing, it waits while the queue is full
+func (w *dbWriter) enqueue(message Message) {
+	w.queue <- message
+}
+
+// exclusive runs fn on the writer goroutine after the pending batch is written and
+// returns its error. Messages keep queuing up while fn runs, so it suits maintenance
+// like VACUUM that would otherwise hold the database lock longer than the busy timeout.
+func (w *dbWriter) exclusive(fn func() error) error {
+	done := make(chan error, 1)
+	w.tasks <- writerTask{fn: fn, done: done}
+	return <-done
+}
+
+// stats returns the current writer metrics
+func (w *dbWriter) stats() writerStats {
+	return writerStats{
+		QueueDepth:    len(w.queue),
+		QueueCapacity: cap(w.queue),
+		Written:       w.written.Load(),
+		Failed:        w.failed.Load(),
+		Batches:       w.batches.Load(),
+	}
+}
+
+// run writes queued messages until the queue is closed. A batch is written when
+// it is full or when the flush interval has passed, whichever comes first.
+func (w *dbWriter) run() {
+	if err := w.prepare(); err != nil {
+		log.Fatalf("Error preparing the database writer: %v", err)
+	}
+	defer w.close()
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Message, 0, w.batchSize)
+	for {
+		select {
+		case message, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, message)
+			if len(batch) >= w.batchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case task := <-w.tasks:
+			w.flush(batch)
+			batch = batch[:0]
+			task.done <- task.fn()
+		}
+	}
+}
+
+// prepare prepares the insert statements and reads the last message ID
+func (w *dbWriter) prepare() error {
+	var err error
+	w.insertMessage, err = db.Prepare(`
+	INSERT INTO mqtt_data_received (topic, message, payload, encoding, qos, retained, duplicate, message_id, received_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`)
+	if err != nil {
+		return err
+	}
+
+	w.insertValue, err = db.Prepare(`
+	INSERT INTO mqtt_data_values (message_id, topic, field, item, value_type, value_num, value_text, unit, received_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`)
+	if err != nil {
+		w.insertMessage.Close()
+		return err
+	}
+
+	// AUTOINCREMENT keeps the highest ID ever used in sqlite_sequence
+	return db.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM sqlite_sequence WHERE name = 'mqtt_data_received';`).Scan(&w.lastID)
+}
+
+// close closes the insert statements
+func (w *dbWriter) close() {
+	w.insertMessage.Close()
+	w.insertValue.Close()
+}
+
+// flush inserts the batch in one transaction, it is tried again a few times
+// when it fails. After the commit the messages get their row IDs and are handed
+// to the frontend. A batch that can't be written is dropped, but its messages
+// still go to the frontend with IDs that the database won't use.
+func (w *dbWriter) flush(batch []Message) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	delay := dbWriteRetryDelay
+	for attempt := 1; attempt <= dbWriteAttempts; attempt++ {
+		start := time.Now()
+		err = w.insert(batch)
+		dbInsertDuration.Observe(time.Since(start).Seconds())
+		if err == nil {
+			break
+		}
+		dbInsertErrors.Inc()
+		if attempt < dbWriteAttempts {
+			log.Printf("Error writing %d messages to database, trying again in %s: %v", len(batch), delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	if err != nil {
+		log.Printf("Error writing %d messages to database, dropping them: %v", len(batch), err)
+		w.failed.Add(int64(len(batch)))
+		for i := range batch {
+			w.lastID++
+			batch[i].ID = w.lastID
+		}
+		w.reserved = w.lastID
+	} else {
+		w.written.Add(int64(len(batch)))
+		w.batches.Add(1)
+		w.lastID, w.reserved = batch[len(batch)-1].ID, 0
+	}
+
+	// Keep the newest messages in memory for /messages and /events
+	messageBuffer.add(batch...)
+
+	// Push the messages to the connected stream clients
+	for _, message := range batch {
+		hub.broadcast(message)
+	}
+}
+
+// insertBatch inserts the messages with their decoded fields and sets their IDs
+func (w *dbWriter) insertBatch(batch []Message) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Skip the IDs of dropped messages
+	if w.reserved > 0 {
+		_, err := tx.Exec(`
+		INSERT INTO sqlite_sequence (name, seq) SELECT 'mqtt_data_received', 0
+		WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = 'mqtt_data_received');
+		UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = 'mqtt_data_received';
+		`, w.reserved)
+		if err != nil {
+			return err
+		}
+	}
+
+	insertMessage := tx.Stmt(w.insertMessage)
+	insertValue := tx.Stmt(w.insertValue)
+	for i := range batch {
+		receivedAt := batch[i].ReceivedAt.UTC().Format(dbTimeLayout)
+		text, payload, encoding, err := payloadColumns(batch[i])
+		if err != nil {
+			return err
+		}
+		result, err := insertMessage.Exec(batch[i].Topic, text, payload, encoding,
+			batch[i].QoS, batch[i].Retained, batch[i].Duplicate, batch[i].MessageID, receivedAt)
+		if err != nil {
+			return err
+		}
+		if batch[i].ID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+
+		for name, field := range batch[i].Fields {
+			if err := insertFieldValues(insertValue, batch[i], receivedAt, name, field); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// insertFieldValues inserts the values of a decoded field, one row per value.
+// The item column is NULL for single values and the index for values of "*" paths.
+func insertFieldValues(stmt *sql.Stmt, message Message, receivedAt string, name string, field *Field) error {
+	if field.Values == nil {
+		num, text := fieldColumns(field.Value)
+		_, err := stmt.Exec(message.ID, message.Topic, name, nil, field.Type, num, text, field.Unit, receivedAt)
+		return err
+	}
+	for item, value := range field.Values {
+		num, text := fieldColumns(value)
+		if _, err := stmt.Exec(message.ID, message.Topic, name, item, field.Type, num, text, field.Unit, receivedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Values of the encoding column
+const (
+	dbEncodingUTF8   = "utf8"   // The payload is in the message column
+	dbEncodingBinary = "binary" // The payload is in the payload column, message is NULL
+)
+
+// encodePayload returns the payload as it is kept in Message.Message and its encoding
+func encodePayload(payload []byte) (string, string) {
+	if utf8.Valid(payload) {
+		return string(payload), encodingUTF8
+	}
+	return base64.StdEncoding.EncodeToString(payload), encodingBase64
+}
+
+// payloadColumns returns the message, payload and encoding columns for a message.
+// Text payloads go to message, so they can be searched and charted.
+func payloadColumns(m Message) (any, any, string, error) {
+	if m.Encoding != encodingBase64 {
+		return m.Message, nil, dbEncodingUTF8, nil
+	}
+	payload, err := base64.StdEncoding.DecodeString(m.Message)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return nil, payload, dbEncodingBinary, nil
+}
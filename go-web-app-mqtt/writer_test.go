@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestWriter returns a writer on the test database whose first failures
+// inserts fail
+func newTestWriter(t *testing.T, failures int) *dbWriter {
+	t.Helper()
+	openTestDatabase(t)
+	messageBuffer = newMessageRing(100)
+
+	w := newDBWriter(0, 0, 0)
+	if err := w.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.close)
+	w.insert = func(batch []Message) error {
+		if failures > 0 {
+			failures--
+			return errors.New("database is locked")
+		}
+		return w.insertBatch(batch)
+	}
+	return w
+}
+
+func testBatch(topics ...string) []Message {
+	batch := make([]Message, len(topics))
+	for i, topic := range topics {
+		batch[i] = Message{Topic: topic, Message: "1", Encoding: encodingUTF8, ReceivedAt: time.Now()}
+	}
+	return batch
+}
+
+func storedIDs(t *testing.T) []int64 {
+	t.Helper()
+	rows, err := db.Query(`SELECT id FROM mqtt_data_received ORDER BY id;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func bufferedIDs() []int64 {
+	messages, _ := messageBuffer.recent([]string{"#"}, 100)
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+func TestWriterRetriesFailedBatch(t *testing.T) {
+	w := newTestWriter(t, dbWriteAttempts-1)
+	w.flush(testBatch("plc/1", "plc/2"))
+
+	if stats := w.stats(); stats.Written != 2 || stats.Failed != 0 || stats.Batches != 1 {
+		t.Errorf("got stats %+v, want 2 written in 1 batch", stats)
+	}
+	if got, want := storedIDs(t), []int64{1, 2}; !slices.Equal(got, want) {
+		t.Errorf("got stored IDs %v, want %v", got, want)
+	}
+	if got, want := bufferedIDs(), []int64{1, 2}; !slices.Equal(got, want) {
+		t.Errorf("got buffered IDs %v, want %v", got, want)
+	}
+}
+
+func TestWriterDropsBatchAfterRetries(t *testing.T) {
+	w := newTestWriter(t, 0)
+	w.flush(testBatch("plc/1"))
+
+	// Every attempt of the second batch fails, the third one is written again
+	failures := dbWriteAttempts
+	insert := w.insert
+	w.insert = func(batch []Message) error {
+		if failures > 0 {
+			failures--
+			return errors.New("database is locked")
+		}
+		return insert(batch)
+	}
+	w.flush(testBatch("plc/2", "plc/3"))
+	w.flush(testBatch("plc/4"))
+
+	if stats := w.stats(); stats.Written != 2 || stats.Failed != 2 || stats.Batches != 2 {
+		t.Errorf("got stats %+v, want 2 written in 2 batches and 2 failed", stats)
+	}
+
+	// The dropped messages still reach the frontend, and the database doesn't
+	// reuse their IDs
+	if got, want := bufferedIDs(), []int64{1, 2, 3, 4}; !slices.Equal(got, want) {
+		t.Errorf("got buffered IDs %v, want %v", got, want)
+	}
+	if got, want := storedIDs(t), []int64{1, 4}; !slices.Equal(got, want) {
+		t.Errorf("got stored IDs %v, want %v", got, want)
+	}
+}
+
+func TestWriterDropsFirstBatch(t *testing.T) {
+	// Without any row sqlite_sequence has no entry for the table yet
+	w := newTestWriter(t, dbWriteAttempts)
+	w.flush(testBatch("plc/1"))
+	w.flush(testBatch("plc/2"))
+
+	if got, want := bufferedIDs(), []int64{1, 2}; !slices.Equal(got, want) {
+		t.Errorf("got buffered IDs %v, want %v", got, want)
+	}
+	if got, want := storedIDs(t), []int64{2}; !slices.Equal(got, want) {
+		t.Errorf("got stored IDs %v, want %v", got, want)
+	}
+}
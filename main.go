@@ -1,15 +1,15 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/joho/godotenv"
+	"go-mqtt-broker/mqttclient"
 )
 
 // Load .env file if it exists in the init function
@@ -25,93 +25,69 @@ func init() {
 	log.Println("MQTT_TOPIC:", os.Getenv("MQTT_TOPIC"))
 }
 
-// Utility function to get environment variables with a fallback default
-func getEnv(key, fallback string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
-	}
-	return fallback
-}
-
 // Handle subscription messages
-func messageHandler(client mqtt.Client, msg mqtt.Message) {
-	log.Printf("Received message on topic %s: %s", msg.Topic(), string(msg.Payload()))
-}
-
-// Wait for a token to complete or a timeout
-func waitWithTimeout(token mqtt.Token, timeout time.Duration) error {
-	done := make(chan struct{})
-
-	// Wait in a separate goroutine
-	go func() {
-		token.Wait()
-		close(done)
-	}()
-
-	// Use a select statement to either wait for the token or timeout
-	select {
-	case <-done:
-		return token.Error()
-	case <-time.After(timeout):
-		return fmt.Errorf("operation timed out after %s", timeout)
+func messageHandler(msg mqttclient.Message) {
+	log.Printf("Received message on topic %s: %s", msg.Topic, string(msg.Payload))
+	// User properties of MQTT 5 messages
+	for _, property := range msg.UserProperties {
+		log.Printf("  %s: %s", property.Key, property.Value)
 	}
 }
 
-// Setup MQTT client and return the client object
-func connectToMQTT(broker, clientID string, timeout time.Duration, username string, password string) mqtt.Client {
-	// Generate a unique client ID using the base client ID and a timestamp
-	//uniqueClientID := fmt.Sprintf("%s-%d", clientID, time.Now().UnixNano())
-	// Define the MQTT broker options
-	opts := mqtt.NewClientOptions().AddBroker(broker)
-	opts.SetClientID(clientID)
-	opts.SetCleanSession(true)
-	opts.SetAutoReconnect(true)
-	opts.SetUsername(username)
-	opts.SetPassword(password)
-
-	// Set callback for connection lost (including duplicate client ID detection)
-	opts.OnConnectionLost = onConnectionLost
-	// Create an MQTT client
+// Setup MQTT client and connect it to the broker, onConnect is called every time the client (re)connected
+func connectToMQTT(ctx context.Context, broker string, timeout time.Duration, onConnect func(*mqttclient.Client)) (*mqttclient.Client, error) {
+	// Client ID, credentials, TLS, MQTT version and reconnect policy from the environment
+	envOptions, err := mqttclient.OptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
 
-	client := mqtt.NewClient(opts)
+	// The client logs lost connections, including a hint about duplicate client IDs
+	client, err := mqttclient.New(broker, append([]mqttclient.Option{
+		mqttclient.WithClientID("go_mqtt_client"),
+		mqttclient.WithCredentials("admin", "admin"),
+		// The session is clean and a new client ID starts a new one, so subscribe on every connect
+		mqttclient.WithOnConnect(onConnect),
+	}, envOptions...)...)
+	if err != nil {
+		return nil, err
+	}
 
 	// Connect to the MQTT broker with a timeout
-	token := client.Connect()
-	if err := waitWithTimeout(token, timeout); err != nil {
-		log.Fatalf("Failed to connect to MQTT broker: %v", err)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		return nil, err
 	}
-	log.Println("Connected to MQTT broker")
-	return client
+	log.Printf("Connected to MQTT broker as %s", client.ClientID())
+	return client, nil
 }
 
 // Subscribe to the MQTT topic with a timeout
-func subscribeToTopic(client mqtt.Client, topic string, timeout time.Duration) {
-	// Subscribe to the topic and handle incoming messages
-	//token := client.Subscribe("plc/temperature", 1, messageHandler) // QoS 1
-	token := client.Subscribe(topic, 0, messageHandler)
-	if err := waitWithTimeout(token, timeout); err != nil {
-		log.Fatalf("Failed to subscribe to topic: %v", err)
+func subscribeToTopic(ctx context.Context, client *mqttclient.Client, topic string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := client.Subscribe(ctx, topic, 0, messageHandler); err != nil {
+		return err
 	}
 	log.Printf("Subscribed to topic: %s", topic)
+	return nil
 }
 
-// Gracefully handle system signals and disconnect the client
-func handleShutdown(client mqtt.Client, topic string, timeout time.Duration) {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	// Wait for signal
-	sig := <-sigChan
-	log.Printf("Received signal: %v. Cleaning up...", sig)
+// Wait until ctx is canceled by a signal, then disconnect the client
+func handleShutdown(ctx context.Context, client *mqttclient.Client, topic string, timeout time.Duration) {
+	<-ctx.Done()
+	log.Println("Received signal. Cleaning up...")
 
-	// Unsubscribe from the topic
-	token := client.Unsubscribe(topic)
-	if err := waitWithTimeout(token, timeout); err != nil {
+	// Unsubscribe from the topic, ctx is done already so this gets its own timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := client.Unsubscribe(ctx, topic); err != nil {
 		log.Printf("Failed to unsubscribe from topic: %v", err)
 	}
 
-	// Disconnect the client
-	client.Disconnect(250) // 250 ms to complete any pending operations
+	// Disconnect the client, it waits a moment for pending operations
+	client.Disconnect()
 	log.Println("Disconnected from MQTT broker")
 
 	log.Println("Application exited gracefully")
@@ -119,37 +95,31 @@ func handleShutdown(client mqtt.Client, topic string, timeout time.Duration) {
 
 func main() {
 	// Load environment variables after .env has been loaded
-	mqttBroker := getEnv("MQTT_BROKER", "tcp://localhost:1883")
-	clientID := getEnv("MQTT_CLIENT_ID", "go_mqtt_client")
-	topic := getEnv("MQTT_TOPIC", "test/topic")
-	username := getEnv("USERNAME", "admin")
-	password := getEnv("PASSWORD", "admin")
+	mqttBroker := mqttclient.GetEnv("MQTT_BROKER", "tcp://localhost:1883")
+	topic := mqttclient.GetEnv("MQTT_TOPIC", "test/topic")
 	timeout := 5 * time.Second
 
 	// Log to see if the environment variables are correctly loaded
 	log.Println("Using MQTT_BROKER:", mqttBroker)
-	log.Println("Using MQTT_CLIENT_ID:", clientID)
 	log.Println("Using MQTT_TOPIC:", topic)
-	log.Println("USERNAME: ", username)
-	log.Println("PASSWORD: ", password)
 
-	// Connect to the MQTT broker
-	client := connectToMQTT(mqttBroker, clientID, timeout, username, password)
-
-	// Subscribe to the topic
-	subscribeToTopic(client, topic, timeout)
-
-	// Wait for termination signal and handle shutdown
-	handleShutdown(client, topic, timeout)
-}
+	// SIGINT and SIGTERM cancel ctx, which also aborts a connect or subscribe in progress
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-// Handle connection lost event (for duplicate client IDs)
-func onConnectionLost(client mqtt.Client, err error) {
-	log.Printf("Connection lost: %v", err)
-	if err.Error() == "Connection refused: identifier rejected" {
-		log.Println("Duplicate client ID detected.")
+	// Subscribe to the topic every time the client connects
+	subscribe := func(client *mqttclient.Client) {
+		if err := subscribeToTopic(ctx, client, topic, timeout); err != nil {
+			log.Printf("Failed to subscribe to topic: %v", err)
+		}
 	}
-	if err.Error() == "EOF" {
-		log.Println("Duplicate client ID detected.")
+
+	// Connect to the MQTT broker
+	client, err := connectToMQTT(ctx, mqttBroker, timeout, subscribe)
+	if err != nil {
+		log.Fatalf("Failed to connect to MQTT broker: %v", err)
 	}
+
+	// Wait for termination signal and handle shutdown
+	handleShutdown(ctx, client, topic, timeout)
 }
@@ -0,0 +1,333 @@
+// Package mqttclient is the MQTT client shared by the programs in this repository.
+// It wraps the Paho clients for MQTT 3.1.1 and MQTT 5 with functional options,
+// operations that take a context and errors that can be inspected with
+// errors.Is and errors.As.
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Time the client waits for pending work when it disconnects
+const disconnectQuiesce = 250 * time.Millisecond
+
+// Interval between connect attempts with a renewed client ID, unless set with WithConnectRetry
+const renewRetryInterval = 5 * time.Second
+
+// Message is a message received from the broker
+type Message struct {
+	Topic     string
+	Payload   []byte
+	QoS       byte
+	Retained  bool
+	Duplicate bool
+	MessageID uint16 // Packet ID of QoS 1 and 2 messages, 0 for QoS 0
+
+	// MQTT 5 properties, empty with MQTT 3.1.1
+	UserProperties  []UserProperty
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	MessageExpiry   time.Duration // Remaining lifetime of the message, 0 when it doesn't expire
+}
+
+// MessageHandler is called for every message of a subscription. Handlers of
+// one client run one at a time, a slow handler holds up the others.
+type MessageHandler func(Message)
+
+// conn is the connection of one protocol version, see v3.go and v5.go.
+// Operations return right away, the token completes when the broker answered.
+type conn interface {
+	connect() token
+	isConnected() bool
+	publish(topic string, qos byte, retained bool, payload []byte, props *publishProperties) token
+	subscribe(filter string, qos byte, handler MessageHandler, opts *subscribeOptions) token
+	unsubscribe(filter string) token
+	disconnect(quiesce time.Duration)
+}
+
+// token is an operation in progress, the Paho MQTT 3.1.1 tokens implement it
+type token interface {
+	Done() <-chan struct{}
+	Error() error
+}
+
+// Client is a connection to one MQTT broker. It is safe for concurrent use.
+type Client struct {
+	broker string
+	config config
+
+	mu          sync.Mutex
+	conn        conn // Replaced when the reconnect policy renews the client ID
+	clientID    string
+	connectedAt time.Time // Start of the current connection
+	quickCloses int       // Connections in a row the broker closed within takeoverWindow
+}
+
+// New creates a client for the broker URL, e.g. tcp://localhost:1883 or
+// ssl://broker.local:8883. It doesn't connect yet, see Connect.
+func New(broker string, options ...Option) (*Client, error) {
+	if broker == "" {
+		return nil, configError("broker URL is empty")
+	}
+	c := &Client{broker: broker, config: defaultConfig()}
+	for _, option := range options {
+		if err := option(&c.config); err != nil {
+			return nil, err
+		}
+	}
+	if c.config.topicAliases > 0 && c.config.protocolVersion != 5 {
+		return nil, configError("topic aliases need MQTT 5")
+	}
+	if c.config.tlsConfig != nil && c.config.tlsConfig.InsecureSkipVerify {
+		log.Printf("WARNING: the certificate of %s is not verified", broker)
+	}
+	c.clientID = c.config.clientID
+	var err error
+	if c.conn, err = c.newConn(c.clientID, c.config.connectRetry); err != nil {
+		return nil, configError("%v", err)
+	}
+	return c, nil
+}
+
+// newConn creates the connection of the configured protocol version for the
+// client ID. With a retry interval, the first connect is retried until it succeeds.
+func (c *Client) newConn(clientID string, retry time.Duration) (conn, error) {
+	if c.config.protocolVersion == 5 {
+		return newV5Conn(c, clientID, retry)
+	}
+	return newV3Conn(c, clientID, retry), nil
+}
+
+// current returns the current connection
+func (c *Client) current() conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// Broker returns the broker URL of the client
+func (c *Client) Broker() string {
+	return c.broker
+}
+
+// ProtocolVersion returns the MQTT version the client speaks, 4 for MQTT 3.1.1 or 5
+func (c *Client) ProtocolVersion() int {
+	return c.config.protocolVersion
+}
+
+// ClientID returns the client ID of the connection, it differs from the
+// configured one after the reconnect policy renewed it
+func (c *Client) ClientID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clientID
+}
+
+// IsConnected reports whether the client is connected to the broker right now
+func (c *Client) IsConnected() bool {
+	return c.current().isConnected()
+}
+
+// Connect connects to the broker and waits until the broker accepted the
+// connection or ctx is done. When ctx is done first, the connection attempt is
+// abandoned; it ends at the latest after the connect timeout. Classify tells
+// why the broker refused the connection.
+func (c *Client) Connect(ctx context.Context) error {
+	conn := c.current()
+	p := &Pending{op: "connect", broker: c.broker, token: conn.connect()}
+	err := p.Wait(ctx)
+	if err != nil && ctx.Err() != nil && !p.done() {
+		// Stops retries and closes the connection once the attempt is over
+		conn.disconnect(0)
+	}
+	return err
+}
+
+// ConnectAsync starts connecting to the broker without waiting
+func (c *Client) ConnectAsync() *Pending {
+	return &Pending{op: "connect", broker: c.broker, token: c.current().connect()}
+}
+
+// connected is called by the connection whenever it (re)connected
+func (c *Client) connected() {
+	c.mu.Lock()
+	c.connectedAt = time.Now()
+	c.mu.Unlock()
+	if c.config.onConnect != nil {
+		c.config.onConnect(c)
+	}
+}
+
+// connectionLost is called by the connection when it dropped. It classifies
+// the error, calls the connection lost function and applies the reconnect policy.
+func (c *Client) connectionLost(conn conn, err error) {
+	d := c.classifyLost(err)
+	c.config.onConnectionLost(c, d)
+	if c.config.reconnectPolicy == nil {
+		return
+	}
+	switch c.config.reconnectPolicy(d) {
+	case ActionStayDisconnected:
+		log.Printf("Not reconnecting to MQTT broker %s after %s", c.broker, d.Reason)
+		conn.disconnect(0)
+	case ActionRenewClientID:
+		c.renewClientID(conn)
+	}
+}
+
+// classifyLost classifies the error of a lost connection. MQTT 3.1.1 brokers
+// close the older connection without a reason when another client connects with
+// the same client ID. Then both clients keep taking the connection from each
+// other, so a broker that closes several connections in a row soon after they
+// were made points to a takeover.
+func (c *Client) classifyLost(err error) Disconnect {
+	d := Classify(err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d.Reason == ReasonNetwork && errors.Is(err, io.EOF) && time.Since(c.connectedAt) < takeoverWindow {
+		c.quickCloses++
+	} else {
+		c.quickCloses = 0
+	}
+	if c.quickCloses >= takeoverCloses {
+		d.Reason = ReasonTakeover
+	}
+	return d
+}
+
+// renewClientID replaces the connection that was lost with one that connects
+// with a new client ID. It keeps retrying until it connects, the subscriptions
+// are made again by the OnConnect function.
+func (c *Client) renewClientID(old conn) {
+	// Stops the reconnect of the old connection
+	old.disconnect(0)
+
+	retry := c.config.connectRetry
+	if retry == 0 {
+		retry = renewRetryInterval
+	}
+	c.mu.Lock()
+	if c.conn != old {
+		c.mu.Unlock()
+		return // Disconnected or renewed already
+	}
+	clientID := uniqueClientID(c.config.clientID)
+	conn, err := c.newConn(clientID, retry)
+	if err != nil {
+		c.mu.Unlock()
+		log.Printf("Error renewing the client ID: %v", err)
+		return
+	}
+	c.conn, c.clientID, c.quickCloses = conn, clientID, 0
+	c.mu.Unlock()
+
+	log.Printf("Reconnecting to MQTT broker %s with client ID %q", c.broker, clientID)
+	conn.connect()
+}
+
+// Publish publishes a message and waits until the broker acknowledged it, for
+// QoS 0 until it was sent, or until ctx is done. The options set MQTT 5
+// properties of the message.
+func (c *Client) Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte, options ...PublishOption) error {
+	return c.PublishAsync(topic, qos, retained, payload, options...).Wait(ctx)
+}
+
+// PublishAsync publishes a message without waiting for the broker, so several
+// messages can be in flight at the same time
+func (c *Client) PublishAsync(topic string, qos byte, retained bool, payload []byte, options ...PublishOption) *Pending {
+	p := &Pending{op: "publish", broker: c.broker, topic: topic}
+	props, err := c.publishProperties(options)
+	if err != nil {
+		p.err = err
+	} else if err := ValidateTopic(topic); err != nil {
+		p.err = err
+	} else if qos > 2 {
+		p.err = ErrInvalidQoS
+	} else {
+		p.token = c.current().publish(topic, qos, retained, payload, props)
+	}
+	return p
+}
+
+// Subscribe subscribes to a topic filter and waits until the broker
+// acknowledged it or ctx is done. Messages are passed to the handler. The
+// options set MQTT 5 options of the subscription.
+func (c *Client) Subscribe(ctx context.Context, filter string, qos byte, handler MessageHandler, options ...SubscribeOption) error {
+	p := &Pending{op: "subscribe", broker: c.broker, topic: filter}
+	opts, err := c.subscribeOptions(options)
+	if err != nil {
+		p.err = err
+	} else if err := ValidateFilter(filter); err != nil {
+		p.err = err
+	} else if qos > 2 {
+		p.err = ErrInvalidQoS
+	} else {
+		p.token = c.current().subscribe(filter, qos, handler, opts)
+	}
+	return p.Wait(ctx)
+}
+
+// Unsubscribe removes a subscription and waits until the broker acknowledged
+// it or ctx is done
+func (c *Client) Unsubscribe(ctx context.Context, filter string) error {
+	p := &Pending{op: "unsubscribe", broker: c.broker, topic: filter, token: c.current().unsubscribe(filter)}
+	return p.Wait(ctx)
+}
+
+// Disconnect closes the connection after giving pending work a moment to
+// finish. The client can connect again afterwards.
+func (c *Client) Disconnect() {
+	c.current().disconnect(disconnectQuiesce)
+}
+
+// Pending is an operation the broker hasn't confirmed yet
+type Pending struct {
+	op     string
+	broker string
+	topic  string
+	token  token
+	err    error // Set when the operation was rejected before it was sent
+}
+
+// Wait waits until the operation completed or ctx is done. The error is an
+// *OpError, a ctx that is done before the operation completed is reported
+// with ctx.Err(). The operation itself isn't canceled, the broker may still
+// receive a message whose publish timed out.
+func (p *Pending) Wait(ctx context.Context) error {
+	if p.err != nil {
+		return p.opError(p.err)
+	}
+	select {
+	case <-p.token.Done():
+		return p.opError(p.token.Error())
+	case <-ctx.Done():
+		return p.opError(ctx.Err())
+	}
+}
+
+// done reports whether the operation completed
+func (p *Pending) done() bool {
+	if p.err != nil {
+		return true
+	}
+	select {
+	case <-p.token.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// opError wraps err with the operation, nil stays nil
+func (p *Pending) opError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OpError{Op: p.op, Broker: p.broker, Topic: p.topic, Err: err}
+}
@@ -0,0 +1,440 @@
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testBroker is a minimal MQTT 3.1.1 broker on a local port. It answers
+// connects while connack is set and acknowledges subscribes, unsubscribes and
+// QoS 1 publishes while ack is set, so tests can leave operations pending.
+// Publishes are delivered back to the connection when it subscribed to them.
+// Connections of the client ID in kick are closed right after the connack, like
+// a broker does when another client takes over the client ID.
+type testBroker struct {
+	listener net.Listener
+	connack  atomic.Bool
+	ack      atomic.Bool
+	kick     atomic.Pointer[string]
+	wg       sync.WaitGroup
+}
+
+// startTestBroker starts a broker that answers everything, it stops when the test ends
+func startTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{listener: listener}
+	b.connack.Store(true)
+	b.ack.Store(true)
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				defer conn.Close()
+				b.serve(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		b.wg.Wait()
+	})
+	return b
+}
+
+// url returns the broker URL for the client
+func (b *testBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// serve handles the packets of a connection until the client disconnects
+func (b *testBroker) serve(conn net.Conn) {
+	var filters []string
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			if b.connack.Load() {
+				reply = packets.NewControlPacket(packets.Connack)
+			}
+			if kick := b.kick.Load(); kick != nil && *kick == p.ClientIdentifier && reply != nil {
+				reply.Write(conn)
+				return
+			}
+		case *packets.SubscribePacket:
+			if b.ack.Load() {
+				filters = append(filters, p.Topics...)
+				suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+				suback.MessageID = p.MessageID
+				suback.ReturnCodes = p.Qoss
+				reply = suback
+			}
+		case *packets.UnsubscribePacket:
+			if b.ack.Load() {
+				unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+				unsuback.MessageID = p.MessageID
+				reply = unsuback
+			}
+		case *packets.PublishPacket:
+			if p.Qos == 1 && b.ack.Load() {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				if err := puback.Write(conn); err != nil {
+					return
+				}
+			}
+			for _, filter := range filters {
+				if Match(filter, p.TopicName) {
+					delivery := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+					delivery.TopicName = p.TopicName
+					delivery.Payload = p.Payload
+					reply = delivery
+					break
+				}
+			}
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if reply != nil {
+			if err := reply.Write(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkGoroutines fails the test when more goroutines than before are still
+// running after a grace period
+func checkGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// connect creates a client for the broker and connects it
+func connect(t *testing.T, b *testBroker, options ...Option) *Client {
+	t.Helper()
+	client, err := New(b.url(), append([]Option{WithClientID(t.Name())}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b := startTestBroker(t)
+	before := runtime.NumGoroutine()
+
+	client := connect(t, b)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	received := make(chan Message, 1)
+	if err := client.Subscribe(ctx, "sensors/#", 1, func(m Message) { received <- m }); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish(ctx, "sensors/line1", 1, false, []byte("21.5")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-received:
+		if m.Topic != "sensors/line1" || string(m.Payload) != "21.5" {
+			t.Errorf("received %s %q, want sensors/line1 \"21.5\"", m.Topic, m.Payload)
+		}
+	case <-ctx.Done():
+		t.Fatal("message not received")
+	}
+	if err := client.Unsubscribe(ctx, "sensors/#"); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Disconnect()
+	checkGoroutines(t, before)
+}
+
+func TestPublishTimeoutDoesNotLeak(t *testing.T) {
+	b := startTestBroker(t)
+	before := runtime.NumGoroutine()
+
+	client := connect(t, b)
+	b.ack.Store(false)
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := client.Publish(ctx, "sensors/line1", 1, false, []byte("21.5"))
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want a deadline exceeded error", err)
+		}
+		var opErr *OpError
+		if !errors.As(err, &opErr) || opErr.Op != "publish" || opErr.Topic != "sensors/line1" {
+			t.Fatalf("got %#v, want an *OpError for the publish", err)
+		}
+	}
+
+	client.Disconnect()
+	checkGoroutines(t, before)
+}
+
+func TestSubscribeCanceled(t *testing.T) {
+	b := startTestBroker(t)
+	before := runtime.NumGoroutine()
+
+	client := connect(t, b)
+	b.ack.Store(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := client.Subscribe(ctx, "sensors/#", 1, func(Message) {})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want a canceled error", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := client.Unsubscribe(ctx, "sensors/#"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want a canceled error", err)
+	}
+
+	client.Disconnect()
+	checkGoroutines(t, before)
+}
+
+func TestConnectCanceled(t *testing.T) {
+	b := startTestBroker(t)
+	b.connack.Store(false)
+	before := runtime.NumGoroutine()
+
+	client, err := New(b.url(), WithClientID(t.Name()), WithConnectTimeout(300*time.Millisecond), WithConnectRetry(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := client.Connect(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a deadline exceeded error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("Connect returned after %s, want it to return when the context is done", elapsed)
+	}
+
+	// The abandoned attempt ends with the connect timeout and isn't retried
+	checkGoroutines(t, before)
+	if client.IsConnected() {
+		t.Error("client connected after the context was done")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	client, err := New("tcp://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := client.Publish(ctx, "sensors/line1", 0, false, nil); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("publish without connection: got %v, want ErrNotConnected", err)
+	}
+	if err := client.Publish(ctx, "sensors/#", 0, false, nil); !errors.Is(err, ErrInvalidTopic) {
+		t.Errorf("publish to a wildcard: got %v, want ErrInvalidTopic", err)
+	}
+	if err := client.Subscribe(ctx, "sensors/#/x", 0, func(Message) {}); !errors.Is(err, ErrInvalidTopic) {
+		t.Errorf("subscribe to an invalid filter: got %v, want ErrInvalidTopic", err)
+	}
+	if err := client.Subscribe(ctx, "sensors/#", 3, func(Message) {}); !errors.Is(err, ErrInvalidQoS) {
+		t.Errorf("subscribe with QoS 3: got %v, want ErrInvalidQoS", err)
+	}
+	if _, err := New(""); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("empty broker URL: got %v, want ErrInvalidConfig", err)
+	}
+	if _, err := New("tcp://127.0.0.1:1", WithTLSSettings(&TLSSettings{CertFile: "client.pem"})); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("certificate without key: got %v, want ErrInvalidConfig", err)
+	}
+	if _, err := New("tcp://127.0.0.1:1", WithProtocolVersion(3)); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("protocol version 3: got %v, want ErrInvalidConfig", err)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err  error
+		want DisconnectReason
+		code byte
+	}{
+		{io.EOF, ReasonNetwork, 0},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, ReasonNetwork, 0},
+		{fmt.Errorf("%w : %w", packets.ErrorNetworkError, io.ErrUnexpectedEOF), ReasonNetwork, 0},
+		{errors.New("pingresp not received, disconnecting"), ReasonKeepAlive, 0},
+		{packets.ErrorRefusedBadUsernameOrPassword, ReasonAuth, 4},
+		{&OpError{Op: "connect", Err: packets.ErrorRefusedNotAuthorised}, ReasonAuth, 5},
+		{packets.ErrorRefusedIDRejected, ReasonTakeover, 2},
+		{packets.ErrorRefusedBadProtocolVersion, ReasonProtocol, 1},
+		{packets.ErrorRefusedServerUnavailable, ReasonServer, 3},
+		{errors.New("something else"), ReasonUnknown, 0},
+	}
+	for _, test := range tests {
+		d := Classify(test.err)
+		if d.Reason != test.want || d.Code != test.code {
+			t.Errorf("Classify(%v) = %s, code %d, want %s, code %d", test.err, d.Reason, d.Code, test.want, test.code)
+		}
+	}
+
+	codes := map[byte]DisconnectReason{
+		0x8E: ReasonTakeover,
+		0x87: ReasonAuth,
+		0x8D: ReasonKeepAlive,
+		0x82: ReasonProtocol,
+		0x8B: ReasonServer,
+		0x80: ReasonUnknown,
+	}
+	for code, want := range codes {
+		if got := ReasonFromCode(code); got != want {
+			t.Errorf("ReasonFromCode(0x%02X) = %s, want %s", code, got, want)
+		}
+	}
+}
+
+func TestRenewClientIDOnTakeover(t *testing.T) {
+	b := startTestBroker(t)
+	id := t.Name()
+	b.kick.Store(&id)
+
+	lost := make(chan Disconnect, 10)
+	connected := make(chan string, 10)
+	client := connect(t, b,
+		WithMaxReconnectInterval(50*time.Millisecond),
+		WithConnectRetry(50*time.Millisecond),
+		WithReconnectPolicy(RenewClientIDOnTakeover),
+		WithOnConnect(func(c *Client) { connected <- c.ClientID() }),
+		WithOnConnectionLost(func(_ *Client, d Disconnect) { lost <- d }),
+	)
+	defer client.Disconnect()
+
+	// The first closes look like network errors, then the client sees the pattern
+	for i := 1; i <= takeoverCloses; i++ {
+		select {
+		case d := <-lost:
+			want := ReasonNetwork
+			if i == takeoverCloses {
+				want = ReasonTakeover
+			}
+			if d.Reason != want {
+				t.Fatalf("close %d: got %s, want %s", i, d, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("close %d: connection not lost", i)
+		}
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case clientID := <-connected:
+			if clientID == id {
+				continue
+			}
+			if !strings.HasPrefix(clientID, id+"-") || client.ClientID() != clientID {
+				t.Fatalf("reconnected as %q, want %q with a suffix", clientID, id)
+			}
+			return
+		case <-deadline:
+			t.Fatal("client didn't reconnect with a new client ID")
+		}
+	}
+}
+
+func TestReconnectPolicyFromEnv(t *testing.T) {
+	t.Setenv("MQTT_RECONNECT_POLICY", "")
+	if policy, err := ReconnectPolicyFromEnv(); policy != nil || err != nil {
+		t.Errorf("got a policy and %v without MQTT_RECONNECT_POLICY", err)
+	}
+
+	t.Setenv("MQTT_RECONNECT_POLICY", "renew-client-id")
+	policy, err := ReconnectPolicyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action := policy(Disconnect{Reason: ReasonTakeover}); action != ActionRenewClientID {
+		t.Errorf("got action %d after a takeover, want %d", action, ActionRenewClientID)
+	}
+
+	t.Setenv("MQTT_RECONNECT_POLICY", "renew")
+	if _, err := ReconnectPolicyFromEnv(); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("got %v, want %v", err, ErrInvalidConfig)
+	}
+}
+
+func TestOptionsFromEnv(t *testing.T) {
+	for _, key := range []string{"MQTT_CLIENT_ID", "USERNAME", "MQTT_PROTOCOL_VERSION", "MQTT_RECONNECT_POLICY", "MQTT_CA_FILE", "MQTT_CERT_FILE", "MQTT_KEY_FILE", "MQTT_SERVER_NAME", "MQTT_INSECURE_SKIP_VERIFY"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+
+	// Without variables the defaults of the program stay
+	options, err := OptionsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := New("tcp://127.0.0.1:1", append([]Option{WithClientID("default")}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.ClientID() != "default" || client.ProtocolVersion() != 4 {
+		t.Errorf("got client ID %q and version %d, want the defaults", client.ClientID(), client.ProtocolVersion())
+	}
+
+	t.Setenv("MQTT_CLIENT_ID", "line1")
+	t.Setenv("MQTT_PROTOCOL_VERSION", "5")
+	if options, err = OptionsFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if client, err = New("tcp://127.0.0.1:1", append([]Option{WithClientID("default")}, options...)...); err != nil {
+		t.Fatal(err)
+	}
+	if client.ClientID() != "line1" || client.ProtocolVersion() != 5 {
+		t.Errorf("got client ID %q and version %d, want line1 and 5", client.ClientID(), client.ProtocolVersion())
+	}
+
+	t.Setenv("MQTT_CERT_FILE", "client.pem")
+	if _, err := OptionsFromEnv(); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("certificate without key: got %v, want %v", err, ErrInvalidConfig)
+	}
+}
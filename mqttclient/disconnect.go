@@ -0,0 +1,171 @@
+package mqttclient
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// A connection the broker closes within takeoverWindow after it was made counts
+// as a quick close. takeoverCloses quick closes in a row are reported as a
+// takeover, see Client.classifyLost.
+const (
+	takeoverWindow = 30 * time.Second
+	takeoverCloses = 3
+)
+
+// DisconnectReason is the cause of a lost connection or a refused connect
+type DisconnectReason int
+
+const (
+	ReasonUnknown   DisconnectReason = iota
+	ReasonNetwork                    // The connection failed or was closed without a reason
+	ReasonTakeover                   // Another client connected with the same client ID, or the broker rejected the ID
+	ReasonAuth                       // Bad credentials or certificate, or the client isn't authorized
+	ReasonKeepAlive                  // The broker didn't answer a ping, or it closed the connection for a missed keep-alive
+	ReasonProtocol                   // Malformed packets, unsupported protocol version or features
+	ReasonServer                     // The broker is unavailable, busy, shutting down or moved
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case ReasonNetwork:
+		return "network error"
+	case ReasonTakeover:
+		return "client ID taken over"
+	case ReasonAuth:
+		return "authentication failure"
+	case ReasonKeepAlive:
+		return "keep-alive timeout"
+	case ReasonProtocol:
+		return "protocol error"
+	case ReasonServer:
+		return "broker unavailable"
+	default:
+		return "unknown"
+	}
+}
+
+// Disconnect describes why a connection was lost or refused
+type Disconnect struct {
+	Reason DisconnectReason
+	Code   byte // Reason code sent by the broker, 0 when it sent none
+	Err    error
+}
+
+func (d Disconnect) String() string {
+	if d.Code != 0 {
+		return fmt.Sprintf("%s (reason code 0x%02X): %v", d.Reason, d.Code, d.Err)
+	}
+	return fmt.Sprintf("%s: %v", d.Reason, d.Err)
+}
+
+// connackErrors maps the MQTT 3.1.1 CONNACK errors of Paho to their return code
+var connackErrors = map[error]byte{
+	packets.ErrorRefusedBadProtocolVersion:    packets.ErrRefusedBadProtocolVersion,
+	packets.ErrorRefusedIDRejected:            packets.ErrRefusedIDRejected,
+	packets.ErrorRefusedServerUnavailable:     packets.ErrRefusedServerUnavailable,
+	packets.ErrorRefusedBadUsernameOrPassword: packets.ErrRefusedBadUsernameOrPassword,
+	packets.ErrorRefusedNotAuthorised:         packets.ErrRefusedNotAuthorised,
+}
+
+// Classify returns the reason of an error returned by Connect or passed to the
+// connection lost function. A single closed connection is a network error,
+// the client itself reports a takeover when the broker keeps closing its
+// connections right after they were made.
+func Classify(err error) Disconnect {
+	d := Disconnect{Err: err}
+	if err == nil {
+		return d
+	}
+	var reasonErr *ReasonCodeError
+	if errors.As(err, &reasonErr) {
+		d.Code = reasonErr.Code
+		d.Reason = ReasonFromCode(reasonErr.Code)
+		return d
+	}
+	for connackErr, code := range connackErrors {
+		if errors.Is(err, connackErr) {
+			d.Code = code
+			d.Reason = ReasonFromCode(code)
+			return d
+		}
+	}
+
+	var verifyErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &verifyErr), errors.As(err, &alertErr):
+		d.Reason = ReasonAuth
+	// Paho doesn't export the error of a missed ping response
+	case strings.HasPrefix(err.Error(), "pingresp not received"):
+		d.Reason = ReasonKeepAlive
+	case errors.Is(err, packets.ErrorProtocolViolation):
+		d.Reason = ReasonProtocol
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed),
+		errors.Is(err, packets.ErrorNetworkError), errors.As(err, &netErr):
+		d.Reason = ReasonNetwork
+	}
+	return d
+}
+
+// ReasonFromCode returns the reason of an MQTT 3.1.1 CONNACK return code or an
+// MQTT 5 CONNACK or DISCONNECT reason code. The code ranges don't overlap.
+func ReasonFromCode(code byte) DisconnectReason {
+	switch code {
+	case 0x02, 0x85, 0x8E: // Identifier rejected, Client Identifier not valid, Session taken over
+		return ReasonTakeover
+	case 0x04, 0x05, 0x86, 0x87, 0x8A, 0x8C: // Bad user name or password, not authorized, banned, bad authentication method
+		return ReasonAuth
+	case 0x8D: // Keep Alive timeout
+		return ReasonKeepAlive
+	case 0x01, 0x81, 0x82, 0x84, 0x8F, 0x90, 0x93, 0x94, 0x95, 0x99, 0x9A, 0x9B, 0x9E, 0xA1, 0xA2:
+		// Unacceptable protocol version, malformed packet, protocol error, invalid topics or
+		// topic aliases, limits exceeded and unsupported features
+		return ReasonProtocol
+	case 0x03, 0x88, 0x89, 0x8B, 0x9C, 0x9D, 0x9F: // Unavailable, busy, shutting down, use another server, moved, connection rate exceeded
+		return ReasonServer
+	default:
+		return ReasonUnknown
+	}
+}
+
+// Action is what the client does after it lost the connection, see WithReconnectPolicy
+type Action int
+
+const (
+	ActionReconnect        Action = iota // Reconnect as set with WithAutoReconnect
+	ActionRenewClientID                  // Reconnect with the configured client ID and a new random suffix
+	ActionStayDisconnected               // Don't reconnect
+)
+
+// ReconnectPolicy decides what the client does after it lost the connection
+type ReconnectPolicy func(Disconnect) Action
+
+// RenewClientIDOnTakeover is a reconnect policy for clients that may be started
+// twice with the same client ID. Instead of taking the connection back and
+// forth, the client that was taken over reconnects with a unique client ID.
+// It stays disconnected when the broker rejected its credentials.
+func RenewClientIDOnTakeover(d Disconnect) Action {
+	switch d.Reason {
+	case ReasonTakeover:
+		return ActionRenewClientID
+	case ReasonAuth:
+		return ActionStayDisconnected
+	default:
+		return ActionReconnect
+	}
+}
+
+// uniqueClientID returns the client ID with a random suffix
+func uniqueClientID(clientID string) string {
+	return fmt.Sprintf("%s-%08x", clientID, rand.Uint32())
+}
@@ -0,0 +1,57 @@
+package mqttclient
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors of the client, use errors.Is to check for them
+var (
+	ErrNotConnected  = errors.New("not connected to the broker")
+	ErrInvalidConfig = errors.New("invalid client configuration")
+	ErrInvalidTopic  = errors.New("invalid topic")
+	ErrInvalidQoS    = errors.New("qos must be 0, 1 or 2")
+	ErrRequiresMQTT5 = errors.New("message properties and subscription options need MQTT 5, the client uses MQTT 3.1.1")
+	ErrNotARequest   = errors.New("message has no response topic")
+)
+
+// OpError is returned by the operations of the client. Err is one of the errors
+// above, a context error when the context was done first, or the error of the
+// broker or the connection.
+type OpError struct {
+	Op     string // connect, publish, subscribe, unsubscribe, request or respond
+	Broker string
+	Topic  string // Topic or topic filter, empty for connect
+	Err    error
+}
+
+func (e *OpError) Error() string {
+	if e.Topic == "" {
+		return fmt.Sprintf("mqtt %s %s: %v", e.Op, e.Broker, e.Err)
+	}
+	return fmt.Sprintf("mqtt %s %s: %v", e.Op, e.Topic, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// configError returns an error wrapping ErrInvalidConfig
+func configError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidConfig, fmt.Sprintf(format, args...))
+}
+
+// ReasonCodeError is a failure reason code an MQTT 5 broker answered with, in
+// a CONNACK, PUBACK, SUBACK, UNSUBACK or DISCONNECT. Classify maps it to a
+// DisconnectReason.
+type ReasonCodeError struct {
+	Code   byte
+	Reason string // Reason string of the broker, often empty
+}
+
+func (e *ReasonCodeError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("reason code 0x%02X (%s)", e.Code, ReasonFromCode(e.Code))
+	}
+	return fmt.Sprintf("reason code 0x%02X: %s", e.Code, e.Reason)
+}
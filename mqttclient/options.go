@@ -0,0 +1,297 @@
+package mqttclient
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// config holds the settings collected from the options
+type config struct {
+	clientID             string
+	username             string
+	password             string
+	tlsConfig            *tls.Config
+	cleanSession         bool
+	autoReconnect        bool
+	connectTimeout       time.Duration // 0 keeps the Paho default of 30 seconds
+	connectRetry         time.Duration // 0 gives up when the first connect fails
+	maxReconnectInterval time.Duration // 0 keeps the Paho default
+	onConnect            func(*Client)
+	onConnectionLost     func(*Client, Disconnect)
+	reconnectPolicy      ReconnectPolicy
+	protocolVersion      int    // 4 for MQTT 3.1.1 or 5
+	topicAliases         uint16 // Aliases the client may use for published topics, MQTT 5 only
+	responseTopicPrefix  string // First level of the response topics of requests
+}
+
+// defaultConfig returns the settings used when no option changes them: a clean
+// session that reconnects automatically and logs lost connections
+func defaultConfig() config {
+	return config{
+		protocolVersion:     4,
+		responseTopicPrefix: defaultResponseTopicPrefix,
+		cleanSession:        true,
+		autoReconnect:       true,
+		onConnectionLost:    logConnectionLost,
+	}
+}
+
+// Option changes a setting of the client, see New
+type Option func(*config) error
+
+// WithProtocolVersion selects the MQTT version: 4 for MQTT 3.1.1, the default,
+// or 5 for MQTT 5 with message properties, reason codes and topic aliases
+func WithProtocolVersion(version int) Option {
+	return func(c *config) error {
+		switch version {
+		case 4, 5:
+			c.protocolVersion = version
+		default:
+			return configError("protocol version must be 4 (MQTT 3.1.1) or 5, not %d", version)
+		}
+		return nil
+	}
+}
+
+// GetEnv returns the environment variable or the fallback when it isn't set
+func GetEnv(key, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return fallback
+}
+
+// OptionsFromEnv returns the options the programs read from environment variables:
+//
+//	MQTT_CLIENT_ID         client ID
+//	USERNAME, PASSWORD     credentials
+//	MQTT_PROTOCOL_VERSION  see ProtocolVersionFromEnv
+//	MQTT_RECONNECT_POLICY  see ReconnectPolicyFromEnv
+//	MQTT_CA_FILE, ...      TLS settings, see TLSSettingsFromEnv
+//
+// Variables that aren't set add no option, so options placed before these in
+// New act as the defaults of a program.
+func OptionsFromEnv() ([]Option, error) {
+	var options []Option
+	if clientID, ok := os.LookupEnv("MQTT_CLIENT_ID"); ok {
+		options = append(options, WithClientID(clientID))
+	}
+	if username, ok := os.LookupEnv("USERNAME"); ok {
+		options = append(options, WithCredentials(username, os.Getenv("PASSWORD")))
+	}
+
+	// TLS settings for ssl:// and mqtts:// brokers
+	tlsSettings, err := TLSSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if tlsSettings != nil {
+		options = append(options, WithTLSSettings(tlsSettings))
+	}
+
+	// MQTT_PROTOCOL_VERSION=5 selects MQTT 5, the default is MQTT 3.1.1
+	if _, ok := os.LookupEnv("MQTT_PROTOCOL_VERSION"); ok {
+		version, err := ProtocolVersionFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithProtocolVersion(version))
+	}
+
+	// MQTT_RECONNECT_POLICY=renew-client-id reconnects with a new client ID after a takeover
+	policy, err := ReconnectPolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		options = append(options, WithReconnectPolicy(policy))
+	}
+	return options, nil
+}
+
+// ProtocolVersionFromEnv reads the MQTT version for WithProtocolVersion from
+// MQTT_PROTOCOL_VERSION, 4 (MQTT 3.1.1) when it isn't set
+func ProtocolVersionFromEnv() (int, error) {
+	value := os.Getenv("MQTT_PROTOCOL_VERSION")
+	if value == "" {
+		return 4, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, configError("invalid MQTT_PROTOCOL_VERSION: %v", err)
+	}
+	return version, nil
+}
+
+// ReconnectPolicyFromEnv reads the policy for WithReconnectPolicy from
+// MQTT_RECONNECT_POLICY: "renew-client-id" for RenewClientIDOnTakeover, nil
+// (reconnect as usual) when it isn't set
+func ReconnectPolicyFromEnv() (ReconnectPolicy, error) {
+	switch value := os.Getenv("MQTT_RECONNECT_POLICY"); value {
+	case "":
+		return nil, nil
+	case "renew-client-id":
+		return RenewClientIDOnTakeover, nil
+	default:
+		return nil, configError("invalid MQTT_RECONNECT_POLICY %q, the only policy is renew-client-id", value)
+	}
+}
+
+// WithTopicAliases lets an MQTT 5 client replace the topics of published
+// messages with up to max numeric aliases, as far as the broker allows. It
+// saves bandwidth when the same topics are published to over and over.
+func WithTopicAliases(max uint16) Option {
+	return func(c *config) error {
+		c.topicAliases = max
+		return nil
+	}
+}
+
+// WithResponseTopicPrefix sets the prefix of the topics Request waits for
+// responses on, default "replies". The broker must allow the client to
+// subscribe below it and the responders to publish there.
+func WithResponseTopicPrefix(prefix string) Option {
+	return func(c *config) error {
+		if err := ValidateTopic(prefix); err != nil {
+			return configError("response topic prefix: %v", err)
+		}
+		c.responseTopicPrefix = prefix
+		return nil
+	}
+}
+
+// WithClientID sets the client ID. Brokers drop the older connection when a
+// second client connects with the same ID.
+func WithClientID(id string) Option {
+	return func(c *config) error {
+		c.clientID = id
+		return nil
+	}
+}
+
+// WithCredentials sets the username and password sent to the broker
+func WithCredentials(username, password string) Option {
+	return func(c *config) error {
+		c.username = username
+		c.password = password
+		return nil
+	}
+}
+
+// WithTLSConfig sets the TLS settings for ssl:// and mqtts:// brokers.
+// Without it, ssl:// brokers are verified with the system CAs.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *config) error {
+		c.tlsConfig = tlsConfig
+		return nil
+	}
+}
+
+// WithTLSSettings loads the certificates of the settings, nil settings are ignored
+func WithTLSSettings(settings *TLSSettings) Option {
+	return func(c *config) error {
+		tlsConfig, err := NewTLSConfig(settings)
+		if err != nil {
+			return configError("%v", err)
+		}
+		if tlsConfig != nil {
+			c.tlsConfig = tlsConfig
+		}
+		return nil
+	}
+}
+
+// WithCleanSession sets whether the broker discards the session when the client
+// disconnects (default true). With false, the broker keeps the subscriptions and
+// queues messages for the client while it is away.
+func WithCleanSession(clean bool) Option {
+	return func(c *config) error {
+		c.cleanSession = clean
+		return nil
+	}
+}
+
+// WithAutoReconnect sets whether the client reconnects after losing the connection (default true)
+func WithAutoReconnect(reconnect bool) Option {
+	return func(c *config) error {
+		c.autoReconnect = reconnect
+		return nil
+	}
+}
+
+// WithConnectTimeout limits how long a single connection attempt may take,
+// including the TLS and MQTT handshakes
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return configError("connect timeout must be positive")
+		}
+		c.connectTimeout = timeout
+		return nil
+	}
+}
+
+// WithConnectRetry makes the client retry the first connect every interval
+// until it succeeds, instead of failing
+func WithConnectRetry(interval time.Duration) Option {
+	return func(c *config) error {
+		if interval <= 0 {
+			return configError("connect retry interval must be positive")
+		}
+		c.connectRetry = interval
+		return nil
+	}
+}
+
+// WithMaxReconnectInterval caps the backoff between reconnect attempts
+func WithMaxReconnectInterval(interval time.Duration) Option {
+	return func(c *config) error {
+		if interval <= 0 {
+			return configError("max reconnect interval must be positive")
+		}
+		c.maxReconnectInterval = interval
+		return nil
+	}
+}
+
+// WithOnConnect sets a function called on every (re)connect. With a clean
+// session it is the place to subscribe.
+func WithOnConnect(onConnect func(*Client)) Option {
+	return func(c *config) error {
+		c.onConnect = onConnect
+		return nil
+	}
+}
+
+// WithOnConnectionLost sets a function called with the reason when the
+// connection drops, instead of the default that logs it
+func WithOnConnectionLost(onConnectionLost func(*Client, Disconnect)) Option {
+	return func(c *config) error {
+		if onConnectionLost == nil {
+			onConnectionLost = func(*Client, Disconnect) {}
+		}
+		c.onConnectionLost = onConnectionLost
+		return nil
+	}
+}
+
+// WithReconnectPolicy sets a function that decides how the client reacts to a
+// lost connection, e.g. RenewClientIDOnTakeover. Without it the client
+// reconnects as set with WithAutoReconnect.
+func WithReconnectPolicy(policy ReconnectPolicy) Option {
+	return func(c *config) error {
+		c.reconnectPolicy = policy
+		return nil
+	}
+}
+
+// logConnectionLost is the default connection lost handler
+func logConnectionLost(c *Client, d Disconnect) {
+	log.Printf("Connection to MQTT broker %s lost: %v", c.broker, d)
+	if d.Reason == ReasonTakeover {
+		log.Printf("Another client may use the client ID %q", c.ClientID())
+	}
+}
@@ -0,0 +1,143 @@
+package mqttclient
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// UserProperty is an MQTT 5 user property, a key may occur more than once
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// publishProperties are the MQTT 5 properties of a published message
+type publishProperties struct {
+	userProperties  []UserProperty
+	contentType     string
+	responseTopic   string
+	correlationData []byte
+	messageExpiry   time.Duration
+}
+
+// PublishOption sets an MQTT 5 property of a published message. Publishing
+// with options fails with ErrRequiresMQTT5 when the client speaks MQTT 3.1.1.
+type PublishOption func(*publishProperties) error
+
+// WithUserProperty adds a user property, a key/value pair the broker passes on to subscribers
+func WithUserProperty(key, value string) PublishOption {
+	return func(p *publishProperties) error {
+		p.userProperties = append(p.userProperties, UserProperty{Key: key, Value: value})
+		return nil
+	}
+}
+
+// WithContentType sets the content type of the payload, e.g. application/json
+func WithContentType(contentType string) PublishOption {
+	return func(p *publishProperties) error {
+		p.contentType = contentType
+		return nil
+	}
+}
+
+// WithResponseTopic sets the topic the receiver should publish its response to
+func WithResponseTopic(topic string) PublishOption {
+	return func(p *publishProperties) error {
+		if err := ValidateTopic(topic); err != nil {
+			return fmt.Errorf("response topic: %w", err)
+		}
+		p.responseTopic = topic
+		return nil
+	}
+}
+
+// WithCorrelationData sets the data that ties a response to its request
+func WithCorrelationData(data []byte) PublishOption {
+	return func(p *publishProperties) error {
+		p.correlationData = data
+		return nil
+	}
+}
+
+// WithMessageExpiry makes the broker discard the message when it couldn't be
+// delivered within the duration, it is rounded up to whole seconds
+func WithMessageExpiry(expiry time.Duration) PublishOption {
+	return func(p *publishProperties) error {
+		if expiry <= 0 || expiry > math.MaxUint32*time.Second {
+			return fmt.Errorf("message expiry must be between 1s and %ds", uint32(math.MaxUint32))
+		}
+		p.messageExpiry = expiry
+		return nil
+	}
+}
+
+// subscribeOptions are the MQTT 5 options of a subscription
+type subscribeOptions struct {
+	noLocal bool
+}
+
+// SubscribeOption sets an MQTT 5 option of a subscription. Subscribing with
+// options fails with ErrRequiresMQTT5 when the client speaks MQTT 3.1.1.
+type SubscribeOption func(*subscribeOptions)
+
+// WithNoLocal keeps the broker from sending the client the messages it
+// published itself, e.g. for a bridge that forwards a topic both ways
+func WithNoLocal() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.noLocal = true
+	}
+}
+
+// subscribeOptions collects the options, nil without options
+func (c *Client) subscribeOptions(options []SubscribeOption) (*subscribeOptions, error) {
+	if len(options) == 0 {
+		return nil, nil
+	}
+	if c.config.protocolVersion != 5 {
+		return nil, ErrRequiresMQTT5
+	}
+	opts := &subscribeOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+	return opts, nil
+}
+
+// publishProperties collects the properties of the options, nil without options
+func (c *Client) publishProperties(options []PublishOption) (*publishProperties, error) {
+	if len(options) == 0 {
+		return nil, nil
+	}
+	if c.config.protocolVersion != 5 {
+		return nil, ErrRequiresMQTT5
+	}
+	props := &publishProperties{}
+	for _, option := range options {
+		if err := option(props); err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
+
+// v5 returns the properties for the Paho MQTT 5 client
+func (p *publishProperties) v5() *paho.PublishProperties {
+	if p == nil {
+		return nil
+	}
+	props := &paho.PublishProperties{
+		ContentType:     p.contentType,
+		ResponseTopic:   p.responseTopic,
+		CorrelationData: p.correlationData,
+	}
+	for _, u := range p.userProperties {
+		props.User.Add(u.Key, u.Value)
+	}
+	if p.messageExpiry > 0 {
+		props.MessageExpiry = paho.Uint32(uint32((p.messageExpiry + time.Second - 1) / time.Second))
+	}
+	return props
+}
@@ -0,0 +1,142 @@
+package mqttclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Time the client takes to remove the subscription of a response after the request ended
+const requestCleanupTimeout = 5 * time.Second
+
+// Default prefix of response topics, see WithResponseTopicPrefix
+const defaultResponseTopicPrefix = "replies"
+
+// envelope carries the response topic and the correlation ID of a request, and
+// the correlation ID of a response, in the payload. MQTT 3.1.1 has no
+// properties for them. JSON payloads are embedded as they are, other payloads
+// as a JSON string.
+type envelope struct {
+	CorrelationID string          `json:"correlation_id"`
+	ResponseTopic string          `json:"response_topic,omitempty"` // Only in requests
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// wrap returns the envelope of the payload. JSON payloads are appended as
+// they are, json.Marshal would compact them.
+func wrap(correlationID, responseTopic string, payload []byte) []byte {
+	if !json.Valid(payload) {
+		payload, _ = json.Marshal(string(payload))
+	}
+	data, _ := json.Marshal(envelope{CorrelationID: correlationID, ResponseTopic: responseTopic, Payload: json.RawMessage("null")})
+	data = bytes.TrimSuffix(data, []byte("null}"))
+	return append(append(data, payload...), '}')
+}
+
+// unwrap decodes an envelope, ok is false when the payload isn't one
+func unwrap(data []byte) (e envelope, payload []byte, ok bool) {
+	if err := json.Unmarshal(data, &e); err != nil || e.CorrelationID == "" || e.Payload == nil {
+		return envelope{}, nil, false
+	}
+	var text string
+	if err := json.Unmarshal(e.Payload, &text); err == nil {
+		return e, []byte(text), true
+	}
+	return e, e.Payload, true
+}
+
+// Request publishes a request to the topic and waits until the response
+// arrived or ctx is done. The response is expected on a topic of its own,
+// {prefix}/{client ID}/{correlation ID}, which the client subscribes to for the
+// time of the request.
+//
+// With MQTT 5 the response topic and the correlation ID are sent as
+// properties, and the responder publishes the response to the response topic
+// with the same correlation data. MQTT 3.1.1 has no properties, so the request
+// is sent as a JSON envelope:
+//
+//	{"correlation_id": "5c0f...", "response_topic": "replies/...", "payload": ...}
+//
+// and the responder publishes {"correlation_id": "5c0f...", "payload": ...} to
+// the response topic. Payloads that are JSON are embedded as they are, others
+// as a JSON string. The payload of the returned message is unwrapped.
+func (c *Client) Request(ctx context.Context, topic string, qos byte, payload []byte) (Message, error) {
+	correlationID := fmt.Sprintf("%016x", rand.Uint64())
+	responseTopic := c.config.responseTopicPrefix + "/" + c.ClientID() + "/" + correlationID
+	v5 := c.config.protocolVersion == 5
+
+	responses := make(chan Message, 1)
+	handler := func(msg Message) {
+		if v5 {
+			if !bytes.Equal(msg.CorrelationData, []byte(correlationID)) {
+				return
+			}
+		} else {
+			e, payload, ok := unwrap(msg.Payload)
+			if !ok || e.CorrelationID != correlationID {
+				return
+			}
+			msg.Payload, msg.CorrelationData = payload, []byte(correlationID)
+		}
+		select {
+		case responses <- msg:
+		default: // Only the first response counts
+		}
+	}
+	if err := c.Subscribe(ctx, responseTopic, qos, handler); err != nil {
+		return Message{}, err
+	}
+	defer func() {
+		// The request may have been canceled, the subscription is removed regardless
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), requestCleanupTimeout)
+		defer cancel()
+		c.Unsubscribe(ctx, responseTopic)
+	}()
+
+	var err error
+	if v5 {
+		err = c.Publish(ctx, topic, qos, false, payload, WithResponseTopic(responseTopic), WithCorrelationData([]byte(correlationID)))
+	} else {
+		err = c.Publish(ctx, topic, qos, false, wrap(correlationID, responseTopic, payload))
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case msg := <-responses:
+		return msg, nil
+	case <-ctx.Done():
+		return Message{}, &OpError{Op: "request", Broker: c.broker, Topic: topic, Err: ctx.Err()}
+	}
+}
+
+// Respond publishes the response to a request sent with Request, the request
+// is the message as it was received. It answers in the convention of the
+// request: with the correlation data property when the request had a response
+// topic property, otherwise with a JSON envelope. It returns ErrNotARequest
+// when the message has no response topic.
+func (c *Client) Respond(ctx context.Context, request Message, qos byte, payload []byte) error {
+	if request.ResponseTopic != "" {
+		return c.Publish(ctx, request.ResponseTopic, qos, false, payload, WithCorrelationData(request.CorrelationData))
+	}
+	e, _, ok := unwrap(request.Payload)
+	if !ok || e.ResponseTopic == "" {
+		return &OpError{Op: "respond", Broker: c.broker, Topic: request.Topic, Err: ErrNotARequest}
+	}
+	return c.Publish(ctx, e.ResponseTopic, qos, false, wrap(e.CorrelationID, "", payload))
+}
+
+// RequestPayload returns the payload of a request sent with Request. It is
+// the payload of the message, unless the request came in a JSON envelope.
+func RequestPayload(request Message) []byte {
+	if request.ResponseTopic == "" {
+		if e, payload, ok := unwrap(request.Payload); ok && e.ResponseTopic != "" {
+			return payload
+		}
+	}
+	return request.Payload
+}
@@ -0,0 +1,85 @@
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// respondOK answers the requests on cmd/# with their payload and " OK"
+func respondOK(t *testing.T, client *Client) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := client.Subscribe(ctx, "cmd/#", 0, func(msg Message) {
+		// Handlers run one at a time, so the response is published in the background
+		go func() {
+			payload := []byte(string(RequestPayload(msg)) + " OK")
+			if err := client.Respond(context.Background(), msg, 0, payload); err != nil {
+				t.Errorf("respond: %v", err)
+			}
+		}()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testRequest(t *testing.T, client *Client) {
+	respondOK(t, client)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, payload := range []string{"start", `{"speed": 10}`} {
+		response, err := client.Request(ctx, "cmd/line1", 0, []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := payload + " OK"; string(response.Payload) != want {
+			t.Errorf("got response %q, want %q", response.Payload, want)
+		}
+		if len(response.CorrelationData) != 16 {
+			t.Errorf("got correlation data %q", response.CorrelationData)
+		}
+	}
+
+	// Nobody answers below nobody/, the request ends with the context
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := client.Request(ctx, "nobody/line1", 0, []byte("start"))
+	var opErr *OpError
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &opErr) || opErr.Op != "request" {
+		t.Errorf("got %v, want a request error with %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	b := startTestBroker(t)
+	before := runtime.NumGoroutine()
+	client := connect(t, b)
+	testRequest(t, client)
+	client.Disconnect()
+	checkGoroutines(t, before)
+}
+
+func TestRequest5(t *testing.T) {
+	b := startTestBroker5(t)
+	before := runtime.NumGoroutine()
+	client := connect5(t, b)
+	testRequest(t, client)
+	client.Disconnect()
+	checkGoroutines(t, before)
+}
+
+func TestRespondNotARequest(t *testing.T) {
+	b := startTestBroker(t)
+	client := connect(t, b)
+	defer client.Disconnect()
+
+	err := client.Respond(context.Background(), Message{Topic: "cmd/line1", Payload: []byte("start")}, 0, nil)
+	if !errors.Is(err, ErrNotARequest) {
+		t.Errorf("got %v, want %v", err, ErrNotARequest)
+	}
+}
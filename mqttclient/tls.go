@@ -0,0 +1,95 @@
+package mqttclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// TLSSettings are the certificate files and options for ssl:// and mqtts://
+// brokers, as they appear in config files
+type TLSSettings struct {
+	CAFile             string `json:"ca_file,omitempty"`              // PEM bundle of the CAs that signed the broker certificate
+	CertFile           string `json:"cert_file,omitempty"`            // PEM client certificate, for brokers that require mutual TLS
+	KeyFile            string `json:"key_file,omitempty"`             // PEM key of the client certificate
+	ServerName         string `json:"server_name,omitempty"`          // Name to verify the broker certificate against
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"` // Accept any broker certificate, only for lab use
+}
+
+// NewTLSConfig loads the certificates of the settings. It returns nil without
+// settings, then ssl:// brokers are verified with the system CAs.
+func NewTLSConfig(settings *TLSSettings) (*tls.Config, error) {
+	if settings == nil {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+	}
+	if settings.CAFile != "" {
+		var err error
+		if config.RootCAs, err = LoadCertPool(settings.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		if settings.CertFile == "" || settings.KeyFile == "" {
+			return nil, fmt.Errorf("cert_file and key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates, for the broker
+// certificate of a client or the client certificates of a TLS listener
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", path)
+	}
+	return pool, nil
+}
+
+// TLSSettingsFromEnv reads the TLS settings from environment variables:
+//
+//	MQTT_CA_FILE               PEM bundle of the CAs that signed the broker certificate
+//	MQTT_CERT_FILE             PEM client certificate, for brokers that require mutual TLS
+//	MQTT_KEY_FILE              PEM key of the client certificate
+//	MQTT_SERVER_NAME           name to verify the broker certificate against, if it differs from the broker host
+//	MQTT_INSECURE_SKIP_VERIFY  true to accept any broker certificate, only for lab use
+//
+// It returns nil when none of them are set.
+func TLSSettingsFromEnv() (*TLSSettings, error) {
+	settings := &TLSSettings{
+		CAFile:     os.Getenv("MQTT_CA_FILE"),
+		CertFile:   os.Getenv("MQTT_CERT_FILE"),
+		KeyFile:    os.Getenv("MQTT_KEY_FILE"),
+		ServerName: os.Getenv("MQTT_SERVER_NAME"),
+	}
+	if value := os.Getenv("MQTT_INSECURE_SKIP_VERIFY"); value != "" {
+		var err error
+		if settings.InsecureSkipVerify, err = strconv.ParseBool(value); err != nil {
+			return nil, configError("invalid MQTT_INSECURE_SKIP_VERIFY: %v", err)
+		}
+	}
+	if *settings == (TLSSettings{}) {
+		return nil, nil
+	}
+	if (settings.CertFile == "") != (settings.KeyFile == "") {
+		return nil, configError("MQTT_CERT_FILE and MQTT_KEY_FILE must be set together")
+	}
+	return settings, nil
+}
@@ -0,0 +1,82 @@
+package mqttclient
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Shared subscriptions have the form $share/{group}/{filter}. The broker passes
+// each message of the filter to one of the clients that subscribed with the group.
+const sharePrefix = "$share/"
+
+// SplitShared returns the group and the topic filter of a shared subscription,
+// the group is empty for other filters
+func SplitShared(filter string) (group, topicFilter string) {
+	rest, ok := strings.CutPrefix(filter, sharePrefix)
+	if !ok {
+		return "", filter
+	}
+	group, topicFilter, _ = strings.Cut(rest, "/")
+	return group, topicFilter
+}
+
+// Match reports whether an MQTT topic matches a topic filter.
+// The filter may contain the single-level wildcard "+" and the multi-level wildcard "#".
+// A shared subscription matches the topics of its filter.
+func Match(filter, topic string) bool {
+	_, filter = SplitShared(filter)
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	// Topics starting with $ are not matched by wildcards at the first level
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// ValidateFilter checks that a topic filter is well formed, the error wraps ErrInvalidTopic
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("%w filter: filter is empty", ErrInvalidTopic)
+	}
+	if group, topicFilter := SplitShared(filter); strings.HasPrefix(filter, sharePrefix) {
+		if group == "" || strings.ContainsAny(group, "+#") || topicFilter == "" {
+			return fmt.Errorf("%w filter %q: shared subscriptions need the form $share/{group}/{filter}", ErrInvalidTopic, filter)
+		}
+		filter = topicFilter
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("%w filter %q: # must occupy the whole last level", ErrInvalidTopic, filter)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("%w filter %q: + must occupy a whole level", ErrInvalidTopic, filter)
+		}
+	}
+	return nil
+}
+
+// ValidateTopic checks that a topic can be published to, the error wraps ErrInvalidTopic
+func ValidateTopic(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("%w: topic is empty", ErrInvalidTopic)
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("%w %q: wildcards are not allowed when publishing", ErrInvalidTopic, topic)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package mqttclient
+
+import (
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v3Conn is an MQTT 3.1.1 connection of the Paho client
+type v3Conn struct {
+	client mqtt.Client
+}
+
+// newV3Conn creates the Paho client for the settings of c and the client ID
+func newV3Conn(c *Client, clientID string, retry time.Duration) *v3Conn {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(c.broker)
+	opts.SetClientID(clientID)
+	opts.SetUsername(c.config.username)
+	opts.SetPassword(c.config.password)
+	opts.SetCleanSession(c.config.cleanSession)
+	opts.SetAutoReconnect(c.config.autoReconnect)
+	if retry > 0 {
+		opts.SetConnectRetry(true)
+		opts.SetConnectRetryInterval(retry)
+	}
+	if c.config.connectTimeout > 0 {
+		opts.SetConnectTimeout(c.config.connectTimeout)
+	}
+	if c.config.maxReconnectInterval > 0 {
+		opts.SetMaxReconnectInterval(c.config.maxReconnectInterval)
+	}
+	if c.config.tlsConfig != nil {
+		opts.SetTLSConfig(c.config.tlsConfig)
+	}
+
+	v3 := &v3Conn{}
+	opts.SetOnConnectHandler(func(mqtt.Client) { c.connected() })
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) { c.connectionLost(v3, err) })
+	v3.client = mqtt.NewClient(opts)
+	return v3
+}
+
+func (v3 *v3Conn) connect() token {
+	return v3Token{v3.client.Connect()}
+}
+
+func (v3 *v3Conn) isConnected() bool {
+	return v3.client.IsConnectionOpen()
+}
+
+// publish publishes the message, props is always nil because MQTT 3.1.1 has no properties
+func (v3 *v3Conn) publish(topic string, qos byte, retained bool, payload []byte, _ *publishProperties) token {
+	return v3Token{v3.client.Publish(topic, qos, retained, payload)}
+}
+
+// subscribe subscribes to the filter, opts is always nil because MQTT 3.1.1 has no subscription options
+func (v3 *v3Conn) subscribe(filter string, qos byte, handler MessageHandler, _ *subscribeOptions) token {
+	return v3Token{v3.client.Subscribe(filter, qos, func(_ mqtt.Client, msg mqtt.Message) {
+		handler(Message{
+			Topic:     msg.Topic(),
+			Payload:   msg.Payload(),
+			QoS:       msg.Qos(),
+			Retained:  msg.Retained(),
+			Duplicate: msg.Duplicate(),
+			MessageID: msg.MessageID(),
+		})
+	})}
+}
+
+func (v3 *v3Conn) unsubscribe(filter string) token {
+	return v3Token{v3.client.Unsubscribe(filter)}
+}
+
+func (v3 *v3Conn) disconnect(quiesce time.Duration) {
+	v3.client.Disconnect(uint(quiesce / time.Millisecond))
+}
+
+// v3Token replaces the not connected error of Paho with ErrNotConnected
+type v3Token struct {
+	mqtt.Token
+}
+
+func (t v3Token) Error() error {
+	if err := t.Token.Error(); err != mqtt.ErrNotConnected {
+		return err
+	}
+	return ErrNotConnected
+}
@@ -0,0 +1,445 @@
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// Settings of MQTT 5 connections that match the defaults of the MQTT 3.1.1 client
+const (
+	v5KeepAlive            = 30 // Seconds
+	v5ConnectTimeout       = 30 * time.Second
+	v5MaxReconnectInterval = 10 * time.Minute
+)
+
+// Session expiry interval of a session that isn't clean, the broker keeps it until the client returns
+const v5SessionNeverExpires = 0xFFFFFFFF
+
+// v5Conn is an MQTT 5 connection. The autopaho connection manager connects
+// and reconnects, the subscriptions and topic aliases are kept here.
+type v5Conn struct {
+	client   *Client
+	clientID string
+	retry    time.Duration
+	url      *url.URL
+	aliases  topicAliases
+
+	mu       sync.Mutex
+	cm       *autopaho.ConnectionManager // nil while disconnected
+	cancel   context.CancelFunc          // Stops the connection manager and ends pending operations
+	ctx      context.Context             // Context of the operations, done when disconnected
+	up       bool
+	everUp   bool // The connection manager connected at least once
+	handlers map[string]MessageHandler
+}
+
+// newV5Conn creates an MQTT 5 connection for the settings of c and the client ID
+func newV5Conn(c *Client, clientID string, retry time.Duration) (*v5Conn, error) {
+	u, err := url.Parse(c.broker)
+	if err != nil {
+		return nil, err
+	}
+	return &v5Conn{
+		client:   c,
+		clientID: clientID,
+		retry:    retry,
+		url:      u,
+		handlers: make(map[string]MessageHandler),
+	}, nil
+}
+
+// connect starts the connection manager. Without a retry interval it is
+// stopped when the first attempt fails, after the first connection it
+// reconnects unless auto reconnect is off.
+func (v5 *v5Conn) connect() token {
+	v5.mu.Lock()
+	defer v5.mu.Unlock()
+	result := newResult()
+	if v5.cm != nil {
+		cm, ctx := v5.cm, v5.ctx
+		go func() { result.complete(cm.AwaitConnection(ctx)) }()
+		return result
+	}
+
+	config := v5.client.config
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{v5.url},
+		TlsCfg:                        config.tlsConfig,
+		KeepAlive:                     v5KeepAlive,
+		CleanStartOnInitialConnection: config.cleanSession,
+		ReconnectBackoff:              v5.backoff,
+		ConnectTimeout:                v5ConnectTimeout,
+		ConnectUsername:               config.username,
+		ConnectPassword:               []byte(config.password),
+		ConnectPacketBuilder: func(cp *paho.Connect, _ *url.URL) (*paho.Connect, error) {
+			v5.aliases.reset(0) // Aliases are set up again for every connection
+			return cp, nil
+		},
+		OnConnectionUp: func(_ *autopaho.ConnectionManager, connack *paho.Connack) {
+			v5.mu.Lock()
+			v5.up, v5.everUp = true, true
+			v5.mu.Unlock()
+			if connack.Properties != nil && connack.Properties.TopicAliasMaximum != nil {
+				v5.aliases.reset(min(config.topicAliases, *connack.Properties.TopicAliasMaximum))
+			}
+			result.complete(nil)
+			v5.client.connected()
+		},
+		OnConnectError: func(err error) {
+			v5.mu.Lock()
+			giveUp := v5.retry == 0 && !v5.everUp
+			v5.mu.Unlock()
+			if giveUp {
+				cancel()
+				result.complete(connackError(err))
+			}
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          v5.clientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){v5.route},
+			OnClientError:     v5.lost,
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				err := &ReasonCodeError{Code: d.ReasonCode}
+				if d.Properties != nil {
+					err.Reason = d.Properties.ReasonString
+				}
+				v5.lost(err)
+			},
+		},
+	}
+	if config.connectTimeout > 0 {
+		cfg.ConnectTimeout = config.connectTimeout
+	}
+	if !config.cleanSession {
+		cfg.SessionExpiryInterval = v5SessionNeverExpires
+	}
+
+	cm, err := autopaho.NewConnection(ctx, cfg)
+	if err != nil {
+		cancel()
+		result.complete(err)
+		return result
+	}
+	v5.cm, v5.ctx, v5.cancel = cm, ctx, cancel
+	v5.up, v5.everUp = false, false
+	go func() {
+		// The connection manager stops when the first attempt failed or auto reconnect is off
+		<-cm.Done()
+		v5.mu.Lock()
+		if v5.cm == cm {
+			v5.cm, v5.up = nil, false
+		}
+		v5.mu.Unlock()
+		result.complete(ErrNotConnected)
+	}()
+	return result
+}
+
+// backoff returns the delay before a connection attempt. The first connect is
+// retried at the retry interval, reconnects start after a second and back off
+// up to the max reconnect interval.
+func (v5 *v5Conn) backoff(attempt int) time.Duration {
+	v5.mu.Lock()
+	everUp := v5.everUp
+	v5.mu.Unlock()
+	if !everUp {
+		if attempt == 0 {
+			return 0
+		}
+		return v5.retry
+	}
+	maxInterval := v5.client.config.maxReconnectInterval
+	if maxInterval == 0 {
+		maxInterval = v5MaxReconnectInterval
+	}
+	return min(time.Second<<min(attempt, 20), maxInterval)
+}
+
+// lost is called when the connection dropped, autopaho reconnects afterwards
+func (v5 *v5Conn) lost(err error) {
+	v5.mu.Lock()
+	v5.up = false
+	if !v5.client.config.autoReconnect {
+		v5.cancel()
+	}
+	v5.mu.Unlock()
+	v5.client.connectionLost(v5, err)
+}
+
+func (v5 *v5Conn) isConnected() bool {
+	v5.mu.Lock()
+	defer v5.mu.Unlock()
+	return v5.up
+}
+
+// manager returns the connection manager and the context of the operations,
+// the manager is nil while the connection is down
+func (v5 *v5Conn) manager() (*autopaho.ConnectionManager, context.Context) {
+	v5.mu.Lock()
+	defer v5.mu.Unlock()
+	if !v5.up {
+		return nil, nil
+	}
+	return v5.cm, v5.ctx
+}
+
+func (v5 *v5Conn) publish(topic string, qos byte, retained bool, payload []byte, props *publishProperties) token {
+	result := newResult()
+	cm, ctx := v5.manager()
+	if cm == nil {
+		result.complete(ErrNotConnected)
+		return result
+	}
+	p := &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: payload, Properties: props.v5()}
+	alias := v5.aliases.assign(p)
+	go func() {
+		resp, err := cm.Publish(ctx, p)
+		alias.done(err == nil && (resp == nil || resp.ReasonCode < 0x80))
+		if resp != nil && resp.ReasonCode >= 0x80 {
+			var reason string
+			if resp.Properties != nil {
+				reason = resp.Properties.ReasonString
+			}
+			err = &ReasonCodeError{Code: resp.ReasonCode, Reason: reason}
+		}
+		result.complete(operationError(err))
+	}()
+	return result
+}
+
+func (v5 *v5Conn) subscribe(filter string, qos byte, handler MessageHandler, opts *subscribeOptions) token {
+	result := newResult()
+	v5.mu.Lock()
+	v5.handlers[filter] = handler
+	v5.mu.Unlock()
+	cm, ctx := v5.manager()
+	if cm == nil {
+		result.complete(ErrNotConnected)
+		return result
+	}
+	go func() {
+		suback, err := cm.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: filter, QoS: qos, NoLocal: opts != nil && opts.noLocal}},
+		})
+		if suback != nil && len(suback.Reasons) == 1 && suback.Reasons[0] >= 0x80 {
+			var reason string
+			if suback.Properties != nil {
+				reason = suback.Properties.ReasonString
+			}
+			err = &ReasonCodeError{Code: suback.Reasons[0], Reason: reason}
+		}
+		result.complete(operationError(err))
+	}()
+	return result
+}
+
+func (v5 *v5Conn) unsubscribe(filter string) token {
+	result := newResult()
+	v5.mu.Lock()
+	delete(v5.handlers, filter)
+	v5.mu.Unlock()
+	cm, ctx := v5.manager()
+	if cm == nil {
+		result.complete(ErrNotConnected)
+		return result
+	}
+	go func() {
+		unsuback, err := cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{filter}})
+		if unsuback != nil && len(unsuback.Reasons) == 1 && unsuback.Reasons[0] >= 0x80 {
+			var reason string
+			if unsuback.Properties != nil {
+				reason = unsuback.Properties.ReasonString
+			}
+			err = &ReasonCodeError{Code: unsuback.Reasons[0], Reason: reason}
+		}
+		result.complete(operationError(err))
+	}()
+	return result
+}
+
+// disconnect stops the connection manager, which sends a DISCONNECT when the
+// connection is up. Pending operations end with a canceled error.
+func (v5 *v5Conn) disconnect(quiesce time.Duration) {
+	v5.mu.Lock()
+	cm, cancel := v5.cm, v5.cancel
+	v5.cm, v5.up = nil, false
+	v5.mu.Unlock()
+	if cm == nil {
+		return
+	}
+	ctx, stop := context.WithTimeout(context.Background(), quiesce)
+	defer stop()
+	cm.Disconnect(ctx)
+	cancel()
+}
+
+// route passes a received message to the handlers of the matching subscriptions
+func (v5 *v5Conn) route(pr paho.PublishReceived) (bool, error) {
+	p := pr.Packet
+	msg := Message{
+		Topic:     p.Topic,
+		Payload:   p.Payload,
+		QoS:       p.QoS,
+		Retained:  p.Retain,
+		Duplicate: p.Duplicate(),
+		MessageID: p.PacketID,
+	}
+	if props := p.Properties; props != nil {
+		for _, u := range props.User {
+			msg.UserProperties = append(msg.UserProperties, UserProperty{Key: u.Key, Value: u.Value})
+		}
+		msg.ContentType = props.ContentType
+		msg.ResponseTopic = props.ResponseTopic
+		msg.CorrelationData = props.CorrelationData
+		if props.MessageExpiry != nil {
+			msg.MessageExpiry = time.Duration(*props.MessageExpiry) * time.Second
+		}
+	}
+
+	v5.mu.Lock()
+	var handlers []MessageHandler
+	for filter, handler := range v5.handlers {
+		if Match(filter, msg.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	v5.mu.Unlock()
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return true, nil
+}
+
+// result is the token of an MQTT 5 operation, it completes once
+type result struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newResult() *result {
+	return &result{done: make(chan struct{})}
+}
+
+func (r *result) complete(err error) {
+	r.once.Do(func() {
+		r.err = err
+		close(r.done)
+	})
+}
+
+func (r *result) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *result) Error() error {
+	<-r.done
+	return r.err
+}
+
+// operationError replaces the errors of autopaho with the errors of this package
+func operationError(err error) error {
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		return ErrNotConnected
+	}
+	return err
+}
+
+// connackError returns the reason code of a refused connect as a *ReasonCodeError
+func connackError(err error) error {
+	var connackErr *autopaho.ConnackError
+	if errors.As(err, &connackErr) {
+		return &ReasonCodeError{Code: connackErr.ReasonCode, Reason: connackErr.Reason}
+	}
+	return err
+}
+
+// topicAliases assigns topic aliases to published topics, up to the maximum
+// the broker accepts on the current connection. The first message to a topic
+// carries the topic and its alias. Later messages only carry the alias once the
+// first one was sent, or acknowledged for QoS 1 and 2; until then they carry
+// the topic, so the broker never gets an alias before the topic it stands for.
+type topicAliases struct {
+	mu         sync.Mutex
+	max        uint16
+	generation int // Counts the connections, results of an older one are ignored
+	aliases    map[string]*topicAlias
+}
+
+// topicAlias is the alias of a topic and whether the broker knows it
+type topicAlias struct {
+	alias    uint16
+	defined  bool // The message that set the alias was sent
+	defining bool // A message that sets the alias is on its way
+}
+
+// aliasResult reports the outcome of a message that set an alias, see done
+type aliasResult struct {
+	aliases    *topicAliases
+	generation int
+	topic      string
+}
+
+// reset forgets the aliases of the previous connection
+func (t *topicAliases) reset(max uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.max = max
+	t.generation++
+	t.aliases = make(map[string]*topicAlias)
+}
+
+// assign sets the topic alias of the message. When the message sets the alias,
+// the result must be passed to done once the message was sent.
+func (t *topicAliases) assign(p *paho.Publish) *aliasResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.max == 0 {
+		return nil
+	}
+	a, ok := t.aliases[p.Topic]
+	if !ok {
+		if len(t.aliases) >= int(t.max) {
+			return nil // No alias left, the topic is always sent in full
+		}
+		a = &topicAlias{alias: uint16(len(t.aliases) + 1)}
+		t.aliases[p.Topic] = a
+	}
+	if a.defining {
+		return nil // The alias may not have arrived yet, send the topic
+	}
+	if p.Properties == nil {
+		p.Properties = &paho.PublishProperties{}
+	}
+	p.Properties.TopicAlias = paho.Uint16(a.alias)
+	if a.defined {
+		p.Topic = ""
+		return nil
+	}
+	a.defining = true
+	return &aliasResult{aliases: t, generation: t.generation, topic: p.Topic}
+}
+
+// done records whether the message that set the alias was sent. When it
+// wasn't, the next message to the topic sets the alias again.
+func (r *aliasResult) done(sent bool) {
+	if r == nil {
+		return
+	}
+	t := r.aliases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.generation != r.generation {
+		return
+	}
+	if a, ok := t.aliases[r.topic]; ok {
+		a.defining, a.defined = false, sent
+	}
+}
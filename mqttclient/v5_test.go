@@ -0,0 +1,418 @@
+package mqttclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// testAliasMaximum is the topic alias maximum of testBroker5
+const testAliasMaximum = 2
+
+// testBroker5 is a minimal MQTT 5 broker on a local port. It refuses connects
+// with the reason code in refuse, allows testAliasMaximum topic aliases (and
+// closes the connection on an unknown one) and
+// denies subscriptions to filters below denied/. Publishes are delivered back
+// with their properties when the connection subscribed to them without the no
+// local option, the topics as
+// they arrived are kept in received. Connections of the client ID in kick get a
+// DISCONNECT with reason code 0x8E (session taken over) after the connack.
+type testBroker5 struct {
+	listener net.Listener
+	refuse   atomic.Uint32
+	kick     atomic.Pointer[string]
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	received []string // Topic and alias of the publishes, e.g. "a/b:1" or ":1"
+}
+
+// startTestBroker5 starts the broker, it stops when the test ends
+func startTestBroker5(t *testing.T) *testBroker5 {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker5{listener: listener}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				defer conn.Close()
+				b.serve(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		b.wg.Wait()
+	})
+	return b
+}
+
+// url returns the broker URL for the client
+func (b *testBroker5) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// serve handles the packets of a connection until the client disconnects
+func (b *testBroker5) serve(conn net.Conn) {
+	var filters []string
+	aliases := make(map[uint16]string)
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply io.WriterTo
+		switch p := cp.Content.(type) {
+		case *packets.Connect:
+			code := byte(b.refuse.Load())
+			connack := &packets.Connack{ReasonCode: code, Properties: &packets.Properties{
+				TopicAliasMaximum: paho.Uint16(testAliasMaximum),
+			}}
+			if _, err := connack.WriteTo(conn); err != nil || code != 0 {
+				return
+			}
+			if kick := b.kick.Load(); kick != nil && *kick == p.ClientID {
+				disconnect := &packets.Disconnect{ReasonCode: 0x8E, Properties: &packets.Properties{}}
+				disconnect.WriteTo(conn)
+				return
+			}
+		case *packets.Subscribe:
+			suback := &packets.Suback{PacketID: p.PacketID, Properties: &packets.Properties{}}
+			for _, sub := range p.Subscriptions {
+				if strings.HasPrefix(sub.Topic, "denied/") {
+					suback.Reasons = append(suback.Reasons, 0x87)
+					continue
+				}
+				if !sub.NoLocal {
+					filters = append(filters, sub.Topic)
+				}
+				suback.Reasons = append(suback.Reasons, sub.QoS)
+			}
+			reply = suback
+		case *packets.Unsubscribe:
+			reply = &packets.Unsuback{PacketID: p.PacketID, Reasons: make([]byte, len(p.Topics)), Properties: &packets.Properties{}}
+		case *packets.Publish:
+			var alias uint16
+			if p.Properties != nil && p.Properties.TopicAlias != nil {
+				alias = *p.Properties.TopicAlias
+			}
+			b.mu.Lock()
+			b.received = append(b.received, fmt.Sprintf("%s:%d", p.Topic, alias))
+			b.mu.Unlock()
+			topic := p.Topic
+			if alias > testAliasMaximum {
+				return
+			} else if alias > 0 && topic == "" {
+				// An alias the broker doesn't know is a protocol error
+				if topic = aliases[alias]; topic == "" {
+					return
+				}
+			} else if alias > 0 {
+				aliases[alias] = topic
+			}
+
+			if p.QoS == 1 {
+				puback := &packets.Puback{PacketID: p.PacketID, Properties: &packets.Properties{}}
+				if _, err := puback.WriteTo(conn); err != nil {
+					return
+				}
+			}
+			for _, filter := range filters {
+				if Match(filter, topic) {
+					props := *p.Properties
+					props.TopicAlias = nil
+					reply = &packets.Publish{Topic: topic, Payload: p.Payload, Properties: &props}
+					break
+				}
+			}
+		case *packets.Pingreq:
+			reply = &packets.Pingresp{}
+		case *packets.Disconnect:
+			return
+		}
+		if reply != nil {
+			if _, err := reply.WriteTo(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// connect5 creates an MQTT 5 client for the broker and connects it
+func connect5(t *testing.T, b *testBroker5, options ...Option) *Client {
+	t.Helper()
+	client, err := New(b.url(), append([]Option{WithClientID(t.Name()), WithProtocolVersion(5)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestPublishSubscribe5(t *testing.T) {
+	b := startTestBroker5(t)
+	before := runtime.NumGoroutine()
+
+	client := connect5(t, b, WithTopicAliases(10))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	received := make(chan Message, 10)
+	if err := client.Subscribe(ctx, "$share/group/test/#", 1, func(msg Message) { received <- msg }); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"test/a", "test/b", "test/c", "test/a"} {
+		err := client.Publish(ctx, topic, 1, false, []byte("hello"),
+			WithUserProperty("site", "plant-1"),
+			WithContentType("text/plain"),
+			WithResponseTopic("test/reply"),
+			WithCorrelationData([]byte{1, 2}),
+			WithMessageExpiry(1500*time.Millisecond),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-received:
+			if msg.Topic != topic || string(msg.Payload) != "hello" {
+				t.Errorf("got %s %q, want %s %q", msg.Topic, msg.Payload, topic, "hello")
+			}
+			if len(msg.UserProperties) != 1 || msg.UserProperties[0] != (UserProperty{"site", "plant-1"}) {
+				t.Errorf("got user properties %v", msg.UserProperties)
+			}
+			if msg.ContentType != "text/plain" || msg.ResponseTopic != "test/reply" || !bytes.Equal(msg.CorrelationData, []byte{1, 2}) {
+				t.Errorf("got content type %q, response topic %q, correlation data %v", msg.ContentType, msg.ResponseTopic, msg.CorrelationData)
+			}
+			if msg.MessageExpiry != 2*time.Second {
+				t.Errorf("got message expiry %s, want 2s", msg.MessageExpiry)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message to %s not received", topic)
+		}
+	}
+
+	// The broker allows two aliases, the third topic is sent in full
+	b.mu.Lock()
+	got := strings.Join(b.received, ",")
+	b.mu.Unlock()
+	if want := "test/a:1,test/b:2,test/c:0,:1"; got != want {
+		t.Errorf("publishes arrived as %q, want %q", got, want)
+	}
+
+	if err := client.Unsubscribe(ctx, "$share/group/test/#"); err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect()
+	checkGoroutines(t, before)
+}
+
+func TestReasonCodes5(t *testing.T) {
+	b := startTestBroker5(t)
+	client := connect5(t, b)
+	defer client.Disconnect()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := client.Subscribe(ctx, "denied/#", 0, func(Message) {})
+	var codeErr *ReasonCodeError
+	if !errors.As(err, &codeErr) || codeErr.Code != 0x87 {
+		t.Fatalf("got %v, want reason code 0x87", err)
+	}
+	if d := Classify(err); d.Reason != ReasonAuth {
+		t.Errorf("Classify(%v) = %s, want %s", err, d.Reason, ReasonAuth)
+	}
+
+	b.refuse.Store(0x86) // Bad user name or password
+	refused, err := New(b.url(), WithProtocolVersion(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = refused.Connect(ctx)
+	if d := Classify(err); d.Reason != ReasonAuth || d.Code != 0x86 {
+		t.Errorf("Classify(%v) = %s, code 0x%02X, want %s, code 0x86", err, d.Reason, d.Code, ReasonAuth)
+	}
+}
+
+func TestTakeover5(t *testing.T) {
+	b := startTestBroker5(t)
+	id := t.Name()
+	b.kick.Store(&id)
+
+	lost := make(chan Disconnect, 10)
+	client := connect5(t, b,
+		WithAutoReconnect(false),
+		WithOnConnectionLost(func(_ *Client, d Disconnect) { lost <- d }),
+	)
+	defer client.Disconnect()
+
+	// MQTT 5 brokers say why they closed the connection, no heuristic needed
+	select {
+	case d := <-lost:
+		if d.Reason != ReasonTakeover || d.Code != 0x8E {
+			t.Errorf("got %s, want %s", d, ReasonTakeover)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not lost")
+	}
+}
+
+func TestRequiresMQTT5(t *testing.T) {
+	b := startTestBroker(t)
+	client := connect(t, b)
+	defer client.Disconnect()
+
+	err := client.Publish(context.Background(), "test/a", 0, false, nil, WithUserProperty("a", "b"))
+	if !errors.Is(err, ErrRequiresMQTT5) {
+		t.Errorf("got %v, want %v", err, ErrRequiresMQTT5)
+	}
+	err = client.Subscribe(context.Background(), "test/#", 0, func(Message) {}, WithNoLocal())
+	if !errors.Is(err, ErrRequiresMQTT5) {
+		t.Errorf("got %v, want %v", err, ErrRequiresMQTT5)
+	}
+	if _, err := New(b.url(), WithTopicAliases(5)); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("got %v, want %v", err, ErrInvalidConfig)
+	}
+}
+
+func TestNoLocal5(t *testing.T) {
+	b := startTestBroker5(t)
+	client := connect5(t, b)
+	defer client.Disconnect()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	received := make(chan Message, 1)
+	if err := client.Subscribe(ctx, "test/#", 1, func(msg Message) { received <- msg }, WithNoLocal()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish(ctx, "test/a", 1, false, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("got own message %s despite no local", msg.Topic)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestTopicAliasesConcurrent5(t *testing.T) {
+	b := startTestBroker5(t)
+	lost := make(chan Disconnect, 1)
+	client := connect5(t, b, WithTopicAliases(10), WithOnConnectionLost(func(_ *Client, d Disconnect) { lost <- d }))
+	defer client.Disconnect()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Publishes that start together may not use the alias before the one setting it arrived.
+	// Large payloads fill the socket buffer, so the writes queue up.
+	payload := bytes.Repeat([]byte("x"), 64*1024)
+	var wg sync.WaitGroup
+	errs := make(chan error, 400)
+	for i := range 400 {
+		qos := byte(i % 2)
+		topic := fmt.Sprintf("test/%d", i%testAliasMaximum)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- client.Publish(ctx, topic, qos, false, payload)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The broker closes the connection on an unknown alias, QoS 0 publishes don't notice
+	if err := client.Publish(ctx, "test/1", 1, false, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-lost:
+		t.Fatalf("connection lost: %s", d)
+	default:
+	}
+
+	b.mu.Lock()
+	last := b.received[len(b.received)-1]
+	b.mu.Unlock()
+	if last != ":1" && last != ":2" {
+		t.Errorf("last publish arrived as %q, want the alias of its topic", last)
+	}
+}
+
+func TestTopicAliasAssign(t *testing.T) {
+	var aliases topicAliases
+	aliases.reset(2)
+	check := func(p *paho.Publish, topic string, alias uint16) {
+		t.Helper()
+		var got uint16
+		if p.Properties != nil && p.Properties.TopicAlias != nil {
+			got = *p.Properties.TopicAlias
+		}
+		if p.Topic != topic || got != alias {
+			t.Errorf("got topic %q and alias %d, want %q and %d", p.Topic, got, topic, alias)
+		}
+	}
+
+	// Until the message setting the alias was sent, the others carry the topic
+	first := &paho.Publish{Topic: "a"}
+	result := aliases.assign(first)
+	check(first, "a", 1)
+	second := &paho.Publish{Topic: "a"}
+	aliases.assign(second)
+	check(second, "a", 0)
+	result.done(true)
+	third := &paho.Publish{Topic: "a"}
+	aliases.assign(third)
+	check(third, "", 1)
+
+	// A message that wasn't sent sets the alias again with the next one
+	failed := &paho.Publish{Topic: "b"}
+	aliases.assign(failed).done(false)
+	retry := &paho.Publish{Topic: "b"}
+	result = aliases.assign(retry)
+	check(retry, "b", 2)
+
+	// Results of the previous connection are ignored
+	aliases.reset(2)
+	result.done(true)
+	fresh := &paho.Publish{Topic: "b"}
+	aliases.assign(fresh)
+	check(fresh, "b", 1)
+	full := &paho.Publish{Topic: "c"}
+	aliases.assign(full)
+	check(full, "c", 2)
+	none := &paho.Publish{Topic: "d"}
+	aliases.assign(none)
+	check(none, "d", 0)
+}